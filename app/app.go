@@ -1,49 +1,89 @@
 package app
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func RunCLI() error {
 	opts := parseFlags()
-	return run(opts)
+	return run(context.Background(), opts)
 }
 
-func run(opts options) error {
+func run(ctx context.Context, opts options) error {
 	if err := validateOptions(&opts); err != nil {
 		return err
 	}
 
-	entries, err := fetchSubscription(opts.subscriptionURL)
+	all, err := loadEntries(ctx, opts)
 	if err != nil {
 		return err
 	}
-	if len(entries) == 0 {
-		return errors.New("в подписке нет поддерживаемых VLESS конфигов")
+	// The exit is looked up before the --country filter: a nearby entry with
+	// a remote exit is the point of a chain.
+	if opts.chainExit != "" {
+		opts.chainExitEntry, err = resolveChainExit(all, opts)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Выход цепочки: %s (ID %s), проверки идут через цепочку\n", opts.chainExitEntry.name, opts.chainExitEntry.id)
+	}
+	entries, err := entryCandidates(all, opts)
+	if err != nil {
+		return err
+	}
+
+	state, err := loadUserState(opts.statePath)
+	if err != nil {
+		fmt.Printf("Состояние не загружено, избранное и последний конфиг не сохраняются: %v\n", err)
 	}
+	state.markFavorites(entries)
 
-	chosen, err := chooseEntry(entries, opts)
+	chosen, err := chooseEntries(ctx, entries, state, opts)
 	if err != nil {
 		return err
 	}
+	state.rememberLast(chosen[0])
+	if err := state.save(); err != nil {
+		fmt.Printf("Состояние не сохранено: %v\n", err)
+	}
 
-	proxyOutbound, err := buildVLESSOutbound(chosen.uri)
+	outbounds, err := buildOutboundSet(chosen, entries, opts)
 	if err != nil {
-		return fmt.Errorf("конвертация %q: %w", chosen.name, err)
+		return err
 	}
 
-	config := buildSingBoxConfig(proxyOutbound, opts)
+	config := buildSingBoxConfig(outbounds, opts)
 	configPath, cleanup, err := writeConfig(config, opts.configPath, opts.keepConfig)
 	if err != nil {
 		return err
 	}
 	defer cleanup()
 
-	fmt.Printf("Выбран конфиг: %s\n", chosen.name)
+	if len(chosen) == 1 {
+		fmt.Printf("Выбран конфиг: %s (ID %s)\n", chosen[0].name, chosen[0].id)
+	} else {
+		fmt.Printf("Выбрана urltest группа из %d конфигов:\n", len(chosen))
+		for _, entry := range chosen {
+			fmt.Printf("  %s (ID %s)\n", entry.name, entry.id)
+		}
+	}
+	if opts.selector {
+		fmt.Printf("Selector \"proxy\": %d конфигов\n", len(outbounds.nodes))
+	}
+	if opts.clashAPI != "" {
+		fmt.Printf("Clash API: http://%s\n", opts.clashAPI)
+	}
 	fmt.Printf("Сгенерирован файл: %s\n", configPath)
 
 	if opts.printConfig {
@@ -69,6 +109,11 @@ func run(opts options) error {
 		}
 	}
 
+	if opts.useTun && opts.tunFakeIP && opts.fakeIPCache != "" {
+		if err := os.MkdirAll(filepath.Dir(opts.fakeIPCache), 0o755); err != nil {
+			return fmt.Errorf("каталог fakeip-cache: %w", err)
+		}
+	}
 	if opts.useTun {
 		fmt.Println("Запуск в TUN режиме. Для Linux обычно требуется sudo/root или CAP_NET_ADMIN.")
 	}
@@ -76,6 +121,82 @@ func run(opts options) error {
 	return runSingBox(opts.singBoxBinary, configPath)
 }
 
+// fetchEntries loads the subscription and applies everything that does not
+// depend on probes: countries and the --country filter.
+func fetchEntries(ctx context.Context, opts options) ([]proxyEntry, error) {
+	entries, err := loadEntries(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return entryCandidates(entries, opts)
+}
+
+// loadEntries fetches the subscription and assigns countries to every node
+// the name or server IP tells; see probeEntriesCountry for the rest.
+func loadEntries(ctx context.Context, opts options) ([]proxyEntry, error) {
+	entries, err := fetchSubscription(opts.subscriptionURL)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("в подписке нет поддерживаемых VLESS конфигов")
+	}
+
+	assignCountries(entries, opts.geoIP)
+	if opts.countries != "" {
+		// The filter decides which nodes exist at all, so server names
+		// are resolved before the menu rather than streamed into it.
+		probeEntriesCountry(ctx, newProbeBoard(entries, false), opts)
+	}
+	return entries, nil
+}
+
+// entryCandidates drops the chain exit and applies the --country filter,
+// which only concerns the nodes a connection enters through.
+func entryCandidates(entries []proxyEntry, opts options) ([]proxyEntry, error) {
+	entries = withoutChainExit(entries, opts)
+	if len(entries) == 0 {
+		return nil, errors.New("кроме выхода цепочки в подписке нет конфигов для входа")
+	}
+	if countries := splitCSV(opts.countries); len(countries) > 0 {
+		entries = filterByCountry(entries, countries)
+		if len(entries) == 0 {
+			return nil, fmt.Errorf("в подписке нет конфигов из стран: %s", strings.Join(countries, ", "))
+		}
+	}
+	return entries, nil
+}
+
+// withAppRules puts the --bypass-process and --proxy-only-process rules in
+// front of the rules file, creating the rules when there is no file.
+func withAppRules(routing *routingRules, opts options) (*routingRules, error) {
+	bypass, proxyOnly := splitCSV(opts.bypassProcess), splitCSV(opts.proxyOnlyProcess)
+	if len(bypass) == 0 && len(proxyOnly) == 0 {
+		return routing, nil
+	}
+	if len(bypass) > 0 && len(proxyOnly) > 0 {
+		return nil, errors.New("--bypass-process и --proxy-only-process нельзя использовать вместе")
+	}
+	if routing == nil {
+		routing = &routingRules{}
+	}
+
+	outbound, values := ruleOutboundDirect, bypass
+	if len(proxyOnly) > 0 {
+		if routing.Final == ruleOutboundProxy {
+			return nil, errors.New("--proxy-only-process противоречит \"final\": \"proxy\" в файле правил")
+		}
+		outbound, values = ruleOutboundProxy, proxyOnly
+		routing.Final = ruleOutboundDirect
+	}
+	rules, err := appRoutingRules(values, outbound)
+	if err != nil {
+		return nil, err
+	}
+	routing.Rules = append(rules, routing.Rules...)
+	return routing, nil
+}
+
 func validateOptions(opts *options) error {
 	if strings.TrimSpace(opts.subscriptionURL) == "" {
 		return errors.New("URL подписки пустой")
@@ -86,6 +207,38 @@ func validateOptions(opts *options) error {
 	if opts.mixedPort < 1 || opts.mixedPort > 65535 {
 		return fmt.Errorf("неверный порт mixed inbound: %d", opts.mixedPort)
 	}
+	opts.rulesPath = strings.TrimSpace(opts.rulesPath)
+	routing, err := loadRoutingRules(opts.rulesPath)
+	if err != nil {
+		return err
+	}
+	opts.routing, err = withAppRules(routing, *opts)
+	if err != nil {
+		return err
+	}
+
+	opts.geoIPPath = strings.TrimSpace(opts.geoIPPath)
+	opts.geoIP, err = loadGeoIPDB(opts.geoIPPath)
+	if err != nil {
+		return err
+	}
+	countries := splitCSV(opts.countries)
+	for i, country := range countries {
+		country = strings.ToUpper(country)
+		if len(country) != 2 || country[0] < 'A' || country[0] > 'Z' || country[1] < 'A' || country[1] > 'Z' {
+			return fmt.Errorf("неверный код страны: %q (ожидается ISO код, например DE)", country)
+		}
+		countries[i] = country
+	}
+	opts.countries = strings.Join(countries, ",")
+
+	family := strings.ReplaceAll(strings.ToLower(strings.TrimSpace(opts.ipFamily)), "-", "_")
+	switch family {
+	case ipFamilyAuto, ipFamilyPreferIPv4, ipFamilyPreferIPv6, ipFamilyIPv4Only, ipFamilyIPv6Only:
+		opts.ipFamily = family
+	default:
+		return fmt.Errorf("неподдерживаемый ip-family: %q", opts.ipFamily)
+	}
 	if !opts.skipRTT {
 		if opts.probeTimeout <= 0 {
 			return fmt.Errorf("неверный probe-timeout: %s", opts.probeTimeout)
@@ -93,6 +246,9 @@ func validateOptions(opts *options) error {
 		if opts.probeWorkers < 1 {
 			return fmt.Errorf("неверный probe-workers: %d", opts.probeWorkers)
 		}
+		if opts.probeSamples < 1 {
+			return fmt.Errorf("неверный probe-samples: %d", opts.probeSamples)
+		}
 	}
 	if opts.healthCheck && !opts.skipHTTP {
 		if opts.healthTimeout <= 0 {
@@ -101,6 +257,9 @@ func validateOptions(opts *options) error {
 		if opts.healthWorkers < 1 {
 			return fmt.Errorf("неверный health-workers: %d", opts.healthWorkers)
 		}
+		if opts.healthSamples < 1 {
+			return fmt.Errorf("неверный health-samples: %d", opts.healthSamples)
+		}
 		healthURL := strings.TrimSpace(opts.healthURL)
 		if healthURL == "" {
 			return errors.New("health-url не может быть пустым, когда health-check включен")
@@ -110,8 +269,165 @@ func validateOptions(opts *options) error {
 			return fmt.Errorf("неверный health-url: %q", opts.healthURL)
 		}
 	}
+	if opts.probeDeadline < 0 {
+		return fmt.Errorf("неверный probe-deadline: %s", opts.probeDeadline)
+	}
+
+	if strings.TrimSpace(opts.historyPath) == "" {
+		opts.noHistory = true
+	}
+
+	if opts.exitIPCheck {
+		if opts.healthTimeout <= 0 {
+			return fmt.Errorf("неверный health-timeout: %s", opts.healthTimeout)
+		}
+		if opts.healthWorkers < 1 {
+			return fmt.Errorf("неверный health-workers: %d", opts.healthWorkers)
+		}
+		parsed, err := parseURL(opts.exitIPURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("неверный exit-ip-url: %q", opts.exitIPURL)
+		}
+	}
+
+	if opts.udpCheck {
+		if opts.healthTimeout <= 0 {
+			return fmt.Errorf("неверный health-timeout: %s", opts.healthTimeout)
+		}
+		if opts.healthWorkers < 1 {
+			return fmt.Errorf("неверный health-workers: %d", opts.healthWorkers)
+		}
+		resolver := strings.TrimSpace(opts.udpDNS)
+		if _, _, err := net.SplitHostPort(resolver); err != nil {
+			resolver = net.JoinHostPort(strings.Trim(resolver, "[]"), "53")
+		}
+		host, port, err := net.SplitHostPort(resolver)
+		if err != nil || host == "" {
+			return fmt.Errorf("неверный udp-dns: %q", opts.udpDNS)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("неверный udp-dns: %q", opts.udpDNS)
+		}
+		opts.udpDNS = resolver
+	}
+
+	if opts.speedTest {
+		if opts.speedTop < 1 {
+			return fmt.Errorf("неверный speed-top: %d", opts.speedTop)
+		}
+		if opts.speedMaxBytes < 1 {
+			return fmt.Errorf("неверный speed-max-bytes: %d", opts.speedMaxBytes)
+		}
+		if opts.speedTimeout <= 0 {
+			return fmt.Errorf("неверный speed-timeout: %s", opts.speedTimeout)
+		}
+		parsed, err := parseURL(opts.speedURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("неверный speed-url: %q", opts.speedURL)
+		}
+	}
+
+	opts.selectID = strings.ToLower(strings.TrimSpace(opts.selectID))
+	opts.selectName = strings.TrimSpace(opts.selectName)
+	selectors := 0
+	for _, set := range []bool{opts.selectedIndex > 0, opts.selectName != "", opts.selectID != "", opts.selectLast} {
+		if set {
+			selectors++
+		}
+	}
+	if selectors > 1 {
+		return errors.New("--select, --select-name, --select-id и --last нельзя использовать вместе")
+	}
+	opts.statePath = strings.TrimSpace(opts.statePath)
+	if opts.selectLast && opts.statePath == "" {
+		return errors.New("--last требует --state-file")
+	}
+
+	opts.group = strings.ToLower(strings.TrimSpace(opts.group))
+	if opts.group != "" {
+		raw, ok := strings.CutPrefix(opts.group, "top:")
+		top, err := strconv.Atoi(raw)
+		if !ok || err != nil || top < 1 {
+			return fmt.Errorf("неверный group: %q (ожидается top:N)", opts.group)
+		}
+		if opts.autoSelect || opts.selectedIndex > 0 || opts.selectID != "" || opts.selectLast {
+			return errors.New("--group нельзя использовать вместе с --auto, --select, --select-id и --last")
+		}
+		opts.groupTop = top
+	}
+	opts.chainExit = strings.TrimSpace(opts.chainExit)
+	opts.chainURL = strings.TrimSpace(opts.chainURL)
+	if opts.chainURL != "" && opts.chainExit == "" {
+		return errors.New("--chain-url работает только с --chain-exit")
+	}
+
+	opts.selectorFilter = strings.TrimSpace(opts.selectorFilter)
+	if opts.selectorFilter != "" && !opts.selector {
+		return errors.New("--selector-filter работает только с --selector")
+	}
+	opts.clashAPI = strings.TrimSpace(opts.clashAPI)
+	if opts.clashAPI == "" && opts.selector {
+		opts.clashAPI = defaultClashAPI
+	}
+	if opts.clashAPI != "" {
+		host, port, err := net.SplitHostPort(opts.clashAPI)
+		if n, convErr := strconv.Atoi(port); err != nil || convErr != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("неверный clash-api: %q (ожидается host:port)", opts.clashAPI)
+		}
+		if !isLoopbackHost(host) && opts.clashSecret == "" {
+			return fmt.Errorf("clash-api %q доступен из сети: нужен --clash-secret", opts.clashAPI)
+		}
+	} else if opts.clashSecret != "" {
+		return errors.New("--clash-secret требует --clash-api или --selector")
+	}
+
+	if opts.urltestInterval < time.Second {
+		return fmt.Errorf("неверный urltest-interval: %s", opts.urltestInterval)
+	}
+	if opts.urltestTolerance < 0 {
+		return fmt.Errorf("неверный urltest-tolerance: %d", opts.urltestTolerance)
+	}
+	if parsed, err := parseURL(opts.urltestURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("неверный urltest-url: %q", opts.urltestURL)
+	}
+
+	if opts.autoSelect || opts.groupTop > 0 {
+		// --group was checked against these flags above.
+		if opts.autoSelect && (opts.selectedIndex > 0 || opts.selectID != "" || opts.selectLast) {
+			return errors.New("--auto нельзя использовать вместе с --select, --select-id и --last")
+		}
+		if opts.autoMaxRTT < 0 {
+			return fmt.Errorf("неверный max-rtt: %s", opts.autoMaxRTT)
+		}
+		if opts.autoMaxRTT > 0 && opts.skipRTT {
+			return errors.New("--max-rtt требует RTT теста")
+		}
+		if opts.autoRequireHTTP && (!opts.healthCheck || opts.skipHTTP) {
+			return errors.New("--require-http требует HTTP-проверки")
+		}
+		if opts.autoRequireUDP && !opts.udpCheck {
+			return errors.New("--require-udp требует --udp-check")
+		}
+	} else if opts.autoMaxRTT != 0 || opts.autoRequireHTTP || opts.autoRequireUDP {
+		return errors.New("--max-rtt, --require-http и --require-udp работают только с --auto и --group")
+	}
+
+	sortBy := strings.ToLower(strings.TrimSpace(opts.sortBy))
+	switch sortBy {
+	case sortByHealth, sortByRTT, sortByHTTP, sortByName, sortByReliability:
+	case sortBySpeed:
+		if !opts.speedTest {
+			return errors.New("--sort speed требует --speed-test")
+		}
+	default:
+		return fmt.Errorf("неподдерживаемый режим сортировки: %q", opts.sortBy)
+	}
+	opts.sortBy = sortBy
 
 	if !opts.useTun {
+		if opts.routing != nil && len(opts.routing.DNS) > 0 {
+			return errors.New("раздел dns в файле правил работает только с --tun")
+		}
 		return nil
 	}
 
@@ -121,6 +437,91 @@ func validateOptions(opts *options) error {
 	if strings.TrimSpace(opts.tunBootstrapDNS) == "" {
 		return errors.New("tun-bootstrap-dns не может быть пустым")
 	}
+	if !validLocalDNS(opts.tunLocalDNS) {
+		return fmt.Errorf("неверный tun-local-dns: %q (ожидается local, dhcp, IP или URL https://, tls://, tcp://, udp://, quic://, h3://)", opts.tunLocalDNS)
+	}
+	if opts.tunDNSIndependentCache && !opts.tunDNSCache {
+		return errors.New("--tun-dns-independent-cache требует --tun-dns-cache")
+	}
+
+	addresses := splitCSV(opts.tunAddress)
+	if len(addresses) == 0 {
+		return errors.New("tun-address не может быть пустым")
+	}
+	for _, address := range addresses {
+		if _, _, err := net.ParseCIDR(address); err != nil {
+			return fmt.Errorf("неверный tun-address: %q (ожидается адрес с маской, например %s)", address, defaultTunAddress)
+		}
+	}
+
+	policy := &opts.tunPolicy
+	strategy := strings.ReplaceAll(strings.ToLower(strings.TrimSpace(policy.dnsStrategy)), "-", "_")
+	if strategy == "" {
+		strategy = defaultTunDNSStrategy
+		if opts.ipFamily != ipFamilyAuto {
+			strategy = opts.ipFamily
+		}
+	}
+	switch strategy {
+	case ipFamilyPreferIPv4, ipFamilyPreferIPv6, ipFamilyIPv4Only, ipFamilyIPv6Only:
+		policy.dnsStrategy = strategy
+	default:
+		return fmt.Errorf("неподдерживаемый tun-dns-strategy: %q", policy.dnsStrategy)
+	}
+	if strategy == ipFamilyIPv6Only && !opts.tunIPv6 && !hasIPv6Prefix(addresses) {
+		return errors.New("tun-dns-strategy ipv6_only требует IPv6 адрес TUN (--tun-ipv6 или IPv6 в --tun-address)")
+	}
+	if policy.autoRedirect && runtime.GOOS != "linux" {
+		return errors.New("--tun-auto-redirect поддерживается только на Linux")
+	}
+	if policy.forceTCP && opts.autoRequireUDP {
+		// A node picked for working UDP must also carry UDP in the final
+		// config, so the default TCP-only mode gives way unless asked for.
+		if opts.explicit["tun-force-tcp"] {
+			return errors.New("--require-udp бессмысленен с --tun-force-tcp: UDP через узел будет отключен")
+		}
+		policy.forceTCP = false
+	}
+	if !policy.addMixedInbound && opts.explicit["port"] {
+		return errors.New("--port задан, но --tun-mixed-inbound=false отключает mixed inbound")
+	}
+
+	if opts.tunFakeIP {
+		for _, fakeRange := range []struct {
+			flag, value string
+			ipv4        bool
+		}{{"fakeip-range", opts.fakeIPRange4, true}, {"fakeip-range6", opts.fakeIPRange6, false}} {
+			ip, _, err := net.ParseCIDR(strings.TrimSpace(fakeRange.value))
+			if err != nil || (ip.To4() != nil) != fakeRange.ipv4 {
+				return fmt.Errorf("неверный %s: %q", fakeRange.flag, fakeRange.value)
+			}
+		}
+		opts.fakeIPRange4 = strings.TrimSpace(opts.fakeIPRange4)
+		opts.fakeIPRange6 = strings.TrimSpace(opts.fakeIPRange6)
+		opts.fakeIPCache = strings.TrimSpace(opts.fakeIPCache)
+	}
+
+	excluded := splitCSV(opts.tunExclude)
+	for i, raw := range excluded {
+		cidr, err := normalizeCIDR(raw)
+		if err != nil {
+			return fmt.Errorf("tun-exclude: %w", err)
+		}
+		excluded[i] = cidr
+	}
+	opts.tunExclude = strings.Join(excluded, ",")
+	if opts.tunFakeIP {
+		// Fake addresses routed around the tunnel would never reach sing-box.
+		for _, fakeRange := range []string{opts.fakeIPRange4, opts.fakeIPRange6} {
+			_, fakeNet, _ := net.ParseCIDR(fakeRange)
+			for _, prefix := range tunExcludeAddresses(*opts) {
+				_, excludedNet, err := net.ParseCIDR(prefix)
+				if err == nil && (excludedNet.Contains(fakeNet.IP) || fakeNet.Contains(excludedNet.IP)) {
+					return fmt.Errorf("диапазон FakeIP %s пересекается с %s, который идет мимо TUN", fakeRange, prefix)
+				}
+			}
+		}
+	}
 
 	stack := strings.ToLower(strings.TrimSpace(opts.tunStack))
 	switch stack {
@@ -132,3 +533,13 @@ func validateOptions(opts *options) error {
 
 	return nil
 }
+
+// isLoopbackHost reports whether a listen host is reachable only from this
+// machine; an empty host listens on all interfaces.
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,152 @@
+package app
+
+import (
+	"flag"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIsLoopbackHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"127.1.2.3", true},
+		{"::1", true},
+		{"localhost", true},
+		{"LocalHost", true},
+		{"", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"192.168.1.10", false},
+		{"example.com", false},
+	}
+	for _, tt := range tests {
+		if got := isLoopbackHost(tt.host); got != tt.want {
+			t.Errorf("isLoopbackHost(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestWithAppRules(t *testing.T) {
+	fileRule := routingRule{Outbound: ruleOutboundProxy, Domain: []string{"example.com"}}
+	tests := []struct {
+		name      string
+		routing   *routingRules
+		bypass    string
+		proxyOnly string
+		want      *routingRules
+		wantErr   string
+	}{
+		{name: "no flags", routing: nil, want: nil},
+		{
+			name:    "bypass before file rules",
+			routing: &routingRules{Rules: []routingRule{fileRule}},
+			bypass:  "steam,uid:1000",
+			want: &routingRules{Rules: []routingRule{
+				{Outbound: ruleOutboundDirect, ProcessName: []string{"steam"}},
+				{Outbound: ruleOutboundDirect, UserID: []int{1000}},
+				fileRule,
+			}},
+		},
+		{
+			name:      "proxy only sends the rest direct",
+			proxyOnly: "firefox",
+			want: &routingRules{
+				Rules: []routingRule{{Outbound: ruleOutboundProxy, ProcessName: []string{"firefox"}}},
+				Final: ruleOutboundDirect,
+			},
+		},
+		{name: "both flags", bypass: "steam", proxyOnly: "firefox", wantErr: "нельзя использовать вместе"},
+		{name: "proxy only against final proxy", routing: &routingRules{Rules: []routingRule{fileRule}, Final: ruleOutboundProxy}, proxyOnly: "firefox", wantErr: "противоречит"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := withAppRules(tt.routing, options{bypassProcess: tt.bypass, proxyOnlyProcess: tt.proxyOnly})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("withAppRules() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func parseTestArgs(t *testing.T, args ...string) options {
+	t.Helper()
+	fs := flag.NewFlagSet("subbox", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	opts, err := parseArgs(fs, append([]string{"--url", "https://example.com/sub"}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opts
+}
+
+func TestValidateOptionsRequireUDPForceTCP(t *testing.T) {
+	tests := []struct {
+		name         string
+		args         []string
+		wantForceTCP bool
+		wantErr      string
+	}{
+		{name: "tun default", args: []string{"--tun", "--auto"}, wantForceTCP: true},
+		{name: "require-udp lifts default", args: []string{"--tun", "--auto", "--udp-check", "--require-udp"}, wantForceTCP: false},
+		{name: "require-udp with force-tcp off", args: []string{"--tun", "--auto", "--udp-check", "--require-udp", "--tun-force-tcp=false"}, wantForceTCP: false},
+		{name: "require-udp with explicit force-tcp", args: []string{"--tun", "--auto", "--udp-check", "--require-udp", "--tun-force-tcp"}, wantErr: "--require-udp бессмысленен"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := parseTestArgs(t, tt.args...)
+			err := validateOptions(&opts)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opts.tunPolicy.forceTCP != tt.wantForceTCP {
+				t.Errorf("forceTCP = %v, want %v", opts.tunPolicy.forceTCP, tt.wantForceTCP)
+			}
+		})
+	}
+}
+
+func TestValidateOptionsSelectionConflicts(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr string
+	}{
+		{[]string{"--auto", "--last"}, "--auto нельзя"},
+		{[]string{"--auto", "--select", "2"}, "--auto нельзя"},
+		{[]string{"--group", "top:3", "--select-id", "abcd1234"}, "--group нельзя"},
+		{[]string{"--group", "top:3", "--auto"}, "--group нельзя"},
+		{[]string{"--group", "top:3"}, ""},
+	}
+	for _, tt := range tests {
+		opts := parseTestArgs(t, tt.args...)
+		err := validateOptions(&opts)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%v: unexpected error: %v", tt.args, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%v: error = %v, want it to contain %q", tt.args, err, tt.wantErr)
+		}
+	}
+}
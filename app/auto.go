@@ -0,0 +1,103 @@
+package app
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// chooseEntriesAuto returns up to limit best-ranked entries that pass the
+// --auto thresholds. Entries must already be sorted by probeEntries.
+func chooseEntriesAuto(entries []proxyEntry, limit int, opts options) ([]proxyEntry, error) {
+	rejected := map[string]int{}
+	var reasons []string
+	var chosen []proxyEntry
+	columns := entryColumns(entries)
+	for _, entry := range entries {
+		reason := autoRejectReason(entry, opts)
+		if reason == "" {
+			fmt.Printf("Автовыбор: [%s] %s\n", renderColumns(entry, columns, ":", " "), displayName(entry))
+			chosen = append(chosen, entry)
+			if len(chosen) == limit {
+				break
+			}
+			continue
+		}
+		if rejected[reason] == 0 {
+			reasons = append(reasons, reason)
+		}
+		rejected[reason]++
+	}
+	if len(chosen) > 0 {
+		if len(chosen) < limit {
+			fmt.Printf("Подошло конфигов: %d из %d запрошенных\n", len(chosen), limit)
+		}
+		return chosen, nil
+	}
+
+	summary := make([]string, 0, len(reasons))
+	for _, reason := range reasons {
+		summary = append(summary, fmt.Sprintf("%s: %d", reason, rejected[reason]))
+	}
+	return nil, fmt.Errorf("автовыбор: ни один из %d конфигов не подошел (%s)", len(entries), strings.Join(summary, ", "))
+}
+
+func autoRejectReason(entry proxyEntry, opts options) string {
+	if !opts.skipRTT {
+		if !entry.tested {
+			return "RTT не проверен"
+		}
+		if entry.probeErr != "" {
+			return "RTT " + entry.probeErr
+		}
+		if opts.autoMaxRTT > 0 && entry.latency > opts.autoMaxRTT {
+			return fmt.Sprintf("RTT > %s", opts.autoMaxRTT)
+		}
+	}
+	if opts.autoRequireHTTP && !(entry.httpTested && entry.httpOK) {
+		return "HTTP не OK"
+	}
+	if opts.autoRequireUDP && !(entry.udpTested && entry.udpOK) {
+		return "UDP не OK"
+	}
+	if entry.exitLeak {
+		return "LEAK"
+	}
+	return ""
+}
+
+func findEntryByID(entries []proxyEntry, id string) (proxyEntry, error) {
+	for _, entry := range entries {
+		if entry.id == id {
+			return entry, nil
+		}
+	}
+	return proxyEntry{}, fmt.Errorf("конфиг с ID %s не найден в подписке", id)
+}
+
+func matchEntriesByName(entries []proxyEntry, pattern string) ([]proxyEntry, error) {
+	matched := filterEntriesByName(entries, pattern)
+	if len(matched) == 0 {
+		return nil, fmt.Errorf("нет конфигов, подходящих под --select-name %q", pattern)
+	}
+	return matched, nil
+}
+
+// filterEntriesByName treats pattern as a case-insensitive regexp; patterns
+// that are not valid regexps fall back to a plain substring match.
+func filterEntriesByName(entries []proxyEntry, pattern string) []proxyEntry {
+	match := func(name string) bool {
+		return strings.Contains(strings.ToLower(name), strings.ToLower(pattern))
+	}
+	if re, err := regexp.Compile("(?i)" + pattern); err == nil {
+		match = re.MatchString
+	}
+
+	var matched []proxyEntry
+	for _, entry := range entries {
+		if match(entry.name) {
+			matched = append(matched, entry)
+		}
+	}
+	return matched
+}
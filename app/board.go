@@ -0,0 +1,192 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// probeBoard holds the entries shared by the probe pipeline and the live
+// menu. The pipeline writes results through update; probe stages and the
+// menu read snapshots, since the menu also writes entries (favourites) while
+// probe workers are running.
+type probeBoard struct {
+	mu      sync.Mutex
+	entries []proxyEntry
+	status  string
+	live    bool
+	changed chan struct{}
+
+	// targets limits a re-test to some nodes (by raw link); nil probes all.
+	// Like entries, it is guarded by mu.
+	targets map[string]bool
+}
+
+func newProbeBoard(entries []proxyEntry, live bool) *probeBoard {
+	return &probeBoard{
+		entries: entries,
+		live:    live,
+		changed: make(chan struct{}, 1),
+	}
+}
+
+func (b *probeBoard) update(fn func(entries []proxyEntry)) {
+	b.mu.Lock()
+	fn(b.entries)
+	b.mu.Unlock()
+	b.notify()
+}
+
+func (b *probeBoard) snapshot() ([]proxyEntry, string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]proxyEntry(nil), b.entries...), b.status
+}
+
+// logf prints a pipeline message, or shows it in the menu status line while
+// the live menu owns the terminal.
+func (b *probeBoard) logf(format string, args ...any) {
+	if !b.live {
+		fmt.Printf(format+"\n", args...)
+		return
+	}
+	b.setStatus(fmt.Sprintf(format, args...))
+}
+
+func (b *probeBoard) setStatus(status string) {
+	b.mu.Lock()
+	b.status = status
+	b.mu.Unlock()
+	b.notify()
+}
+
+func (b *probeBoard) newProgress(label string, total int) *probeProgress {
+	progress := newProbeProgress(label, total)
+	if b.live {
+		progress.live = b.setStatus
+	}
+	return progress
+}
+
+// stage returns a copy of the entries together with the indexes the current
+// run probes, taken under one lock. Probe workers read only the copy.
+func (b *probeBoard) stage() ([]proxyEntry, []int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]proxyEntry(nil), b.entries...), b.targetIndexesLocked()
+}
+
+// targetIndexes returns the indexes of the entries the current run probes, in
+// board order.
+func (b *probeBoard) targetIndexes() []int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.targetIndexesLocked()
+}
+
+// targetIndexesLocked is targetIndexes for callers already holding b.mu.
+func (b *probeBoard) targetIndexesLocked() []int {
+	indexes := make([]int, 0, len(b.entries))
+	for i := range b.entries {
+		if b.targets == nil || b.targets[b.entries[i].raw] {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// retarget selects the nodes for the next run and clears their old results.
+func (b *probeBoard) retarget(targets map[string]bool) {
+	b.update(func(entries []proxyEntry) {
+		b.targets = targets
+		for i := range entries {
+			if targets == nil || targets[entries[i].raw] {
+				entries[i] = entries[i].withoutProbeResults()
+			}
+		}
+	})
+}
+
+func (b *probeBoard) replace(entries []proxyEntry) {
+	b.mu.Lock()
+	b.entries = entries
+	b.targets = nil
+	b.mu.Unlock()
+	b.notify()
+}
+
+func (b *probeBoard) notify() {
+	select {
+	case b.changed <- struct{}{}:
+	default:
+	}
+}
+
+// probeRunner owns the background pipeline behind the live menu. A new run
+// (re-test, subscription refresh) cancels the current one and starts only
+// after it has exited, so one pipeline at a time writes to the board.
+type probeRunner struct {
+	parent context.Context
+	board  *probeBoard
+	opts   options
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newProbeRunner(parent context.Context, board *probeBoard, opts options) *probeRunner {
+	return &probeRunner{parent: parent, board: board, opts: opts}
+}
+
+// probe re-runs the pipeline for targets, or for every node when nil.
+func (r *probeRunner) probe(targets map[string]bool) {
+	r.run(func(ctx context.Context) {
+		r.board.retarget(targets)
+		probeEntries(ctx, r.board, r.opts)
+	})
+}
+
+func (r *probeRunner) run(job func(ctx context.Context)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	previous := r.done
+	if r.cancel != nil {
+		r.cancel()
+	}
+	ctx, cancel := newProbeContext(r.parent, r.opts.probeDeadline)
+	done := make(chan struct{})
+	r.cancel, r.done = cancel, done
+
+	go func() {
+		defer close(done)
+		defer cancel()
+		if previous != nil {
+			<-previous
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		job(ctx)
+	}()
+}
+
+// stop cancels the current run. The returned channel is closed once it has
+// exited; running reports whether there was anything left to wait for.
+func (r *probeRunner) stop() (done <-chan struct{}, running bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancel == nil {
+		closed := make(chan struct{})
+		close(closed)
+		return closed, false
+	}
+	r.cancel()
+	select {
+	case <-r.done:
+		return r.done, false
+	default:
+		return r.done, true
+	}
+}
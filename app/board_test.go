@@ -0,0 +1,61 @@
+package app
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestProbeBoardSnapshotIsolated mirrors a probe stage reading its entries
+// while the menu toggles favourites; run with -race to catch shared reads.
+func TestProbeBoardSnapshotIsolated(t *testing.T) {
+	board := newProbeBoard([]proxyEntry{{key: "a"}, {key: "b"}}, true)
+	entries, _ := board.snapshot()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			entry := entries[i%len(entries)]
+			if entry.favorite {
+				t.Errorf("snapshot saw a favourite toggled after it was taken")
+				return
+			}
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		board.update(func(entries []proxyEntry) {
+			entries[i%len(entries)].favorite = true
+		})
+	}
+	wg.Wait()
+
+	current, _ := board.snapshot()
+	for _, entry := range current {
+		if !entry.favorite {
+			t.Errorf("entry %q: favourite not written to the board", entry.key)
+		}
+	}
+}
+
+func TestProbeBoardStageTargets(t *testing.T) {
+	board := newProbeBoard([]proxyEntry{
+		{raw: "a", probeResults: probeResults{tested: true}},
+		{raw: "b", probeResults: probeResults{tested: true}},
+		{raw: "c", probeResults: probeResults{tested: true}},
+	}, false)
+
+	board.retarget(map[string]bool{"b": true, "c": true})
+	entries, indexes := board.stage()
+	if len(indexes) != 2 || indexes[0] != 1 || indexes[1] != 2 {
+		t.Fatalf("indexes = %v, want [1 2]", indexes)
+	}
+	if !entries[0].tested || entries[1].tested || entries[2].tested {
+		t.Errorf("retarget must clear results of the targets only: %+v", entries)
+	}
+
+	board.replace([]proxyEntry{{raw: "x"}})
+	if _, indexes := board.stage(); len(indexes) != 1 {
+		t.Errorf("replace must reset targets, got indexes %v", indexes)
+	}
+}
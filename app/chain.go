@@ -0,0 +1,71 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// chainEntryTag is the outbound (node or group) the chain exit is dialed
+// through; the exit itself takes the "proxy" tag.
+const chainEntryTag = "chain-entry"
+
+// resolveChainExit finds the --chain-exit node by ID or name, in the
+// --chain-url subscription if given and otherwise among entries.
+func resolveChainExit(entries []proxyEntry, opts options) (*proxyEntry, error) {
+	if opts.chainURL != "" {
+		var err error
+		entries, err = fetchSubscription(opts.chainURL)
+		if err != nil {
+			return nil, fmt.Errorf("подписка выхода цепочки: %w", err)
+		}
+		if len(entries) == 0 {
+			return nil, errors.New("в подписке выхода цепочки нет поддерживаемых VLESS конфигов")
+		}
+	}
+
+	if entry, err := findEntryByID(entries, strings.ToLower(opts.chainExit)); err == nil {
+		return &entry, nil
+	}
+	matched := filterEntriesByName(entries, opts.chainExit)
+	if len(matched) == 0 {
+		return nil, fmt.Errorf("выход цепочки %q не найден ни по ID, ни по имени", opts.chainExit)
+	}
+	if len(matched) > 1 {
+		fmt.Printf("Под --chain-exit подходит конфигов: %d, используется первый\n", len(matched))
+	}
+	return &matched[0], nil
+}
+
+// withoutChainExit drops the exit node from the entry candidates: chaining a
+// node through itself only adds a hop.
+func withoutChainExit(entries []proxyEntry, opts options) []proxyEntry {
+	if opts.chainExitEntry == nil {
+		return entries
+	}
+	filtered := entries[:0:0]
+	for _, entry := range entries {
+		if entry.key != opts.chainExitEntry.key {
+			filtered = append(filtered, entry)
+		}
+	}
+	return filtered
+}
+
+// chainProbeOutbounds puts the chain exit in front of a probed entry node, so
+// HTTP, exit IP, UDP and speed probes measure the whole chain.
+func chainProbeOutbounds(entryOutbound map[string]any, opts options) ([]any, error) {
+	if opts.chainExitEntry == nil {
+		return []any{entryOutbound}, nil
+	}
+	exit, err := buildVLESSOutbound(opts.chainExitEntry.uri)
+	if err != nil {
+		return nil, fmt.Errorf("конвертация %q: %w", opts.chainExitEntry.name, err)
+	}
+	if network, ok := entryOutbound["network"]; ok {
+		exit["network"] = network
+	}
+	entryOutbound["tag"] = chainEntryTag
+	exit["detour"] = chainEntryTag
+	return []any{exit, entryOutbound}, nil
+}
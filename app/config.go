@@ -8,6 +8,22 @@ import (
 	"strings"
 )
 
+// lanRanges are the private, link-local, CGNAT and multicast networks kept
+// out of the tunnel by --tun-bypass-lan.
+var lanRanges = []string{
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"169.254.0.0/16",
+	"100.64.0.0/10",
+	"224.0.0.0/4",
+	// Only the assigned half of fc00::/7: fc00::/8 stays routed into the
+	// tunnel for the FakeIP IPv6 range.
+	"fd00::/8",
+	"fe80::/10",
+	"ff00::/8",
+}
+
 type tunPolicy struct {
 	strictRoute     bool
 	autoRedirect    bool
@@ -29,7 +45,119 @@ func defaultTunPolicy() tunPolicy {
 	}
 }
 
-func buildSingBoxConfig(proxyOutbound map[string]any, opts options) map[string]any {
+// outboundSet is the proxy part of the config: node outbounds and the groups
+// in front of them. Whatever is tagged "proxy" is route.final. With a chain
+// the node or group is tagged chainEntryTag and exit is the "proxy" outbound
+// dialed through it.
+type outboundSet struct {
+	nodes  []map[string]any
+	groups []map[string]any
+	exit   map[string]any
+}
+
+// servers lists every outbound that connects to a node.
+func (s outboundSet) servers() []map[string]any {
+	servers := append([]map[string]any(nil), s.nodes...)
+	if s.exit != nil {
+		servers = append(servers, s.exit)
+	}
+	return servers
+}
+
+// buildOutboundSet converts the chosen nodes. A single node keeps the "proxy"
+// tag; a group of chosen nodes gets a urltest outbound in front. With
+// --selector every node of the subscription (or of --selector-filter) is
+// added and a selector named "proxy" starts on the chosen node or group.
+func buildOutboundSet(chosen, all []proxyEntry, opts options) (outboundSet, error) {
+	members := chosen
+	if opts.selector {
+		pool := all
+		if opts.selectorFilter != "" {
+			pool = filterEntriesByName(all, opts.selectorFilter)
+		}
+		members = append([]proxyEntry(nil), chosen...)
+		seen := map[string]bool{}
+		for _, entry := range chosen {
+			seen[entry.key] = true
+		}
+		for _, entry := range pool {
+			if !seen[entry.key] {
+				seen[entry.key] = true
+				members = append(members, entry)
+			}
+		}
+	}
+
+	finalTag := "proxy"
+	var set outboundSet
+	if opts.chainExitEntry != nil {
+		exit, err := buildVLESSOutbound(opts.chainExitEntry.uri)
+		if err != nil {
+			return outboundSet{}, fmt.Errorf("конвертация %q: %w", opts.chainExitEntry.name, err)
+		}
+		finalTag = chainEntryTag
+		exit["detour"] = finalTag
+		set.exit = exit
+	}
+
+	tags := nodeTags(members)
+	for i, entry := range members {
+		outbound, err := buildVLESSOutbound(entry.uri)
+		if err != nil {
+			return outboundSet{}, fmt.Errorf("конвертация %q: %w", entry.name, err)
+		}
+		outbound["tag"] = finalTag
+		if len(members) > 1 {
+			outbound["tag"] = tags[i]
+		}
+		set.nodes = append(set.nodes, outbound)
+	}
+	if len(members) == 1 {
+		return set, nil
+	}
+
+	if !opts.selector {
+		set.groups = append(set.groups, urltestOutbound(finalTag, tags, opts))
+		return set, nil
+	}
+	selected := tags[0]
+	if len(chosen) > 1 {
+		set.groups = append(set.groups, urltestOutbound("auto", tags[:len(chosen)], opts))
+		selected = "auto"
+		tags = append([]string{"auto"}, tags...)
+	}
+	set.groups = append([]map[string]any{{
+		"type":                        "selector",
+		"tag":                         finalTag,
+		"outbounds":                   tags,
+		"default":                     selected,
+		"interrupt_exist_connections": true,
+	}}, set.groups...)
+	return set, nil
+}
+
+// nodeTags derives unique outbound tags from node names. Names repeat in
+// subscriptions, and the built-in tags must not be shadowed.
+func nodeTags(entries []proxyEntry) []string {
+	used := map[string]bool{"proxy": true, "auto": true, chainEntryTag: true, "direct": true, "block": true}
+	tags := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		base := strings.TrimSpace(entry.name)
+		if base == "" {
+			base = entry.id
+		}
+		tag := base
+		for n := 2; used[tag]; n++ {
+			tag = fmt.Sprintf("%s #%d", base, n)
+		}
+		used[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+func buildSingBoxConfig(set outboundSet, opts options) map[string]any {
+	nodes := set.nodes
 	config := map[string]any{
 		"log": map[string]any{
 			"level": opts.logLevel,
@@ -38,25 +166,28 @@ func buildSingBoxConfig(proxyOutbound map[string]any, opts options) map[string]a
 
 	route := map[string]any{
 		"auto_detect_interface": true,
-		"final":                 "proxy",
+		"final":                 opts.routing.final(),
 	}
 
 	if opts.useTun {
-		policy := defaultTunPolicy()
-		if policy.forceTCP {
-			proxyOutbound["network"] = "tcp"
+		policy := opts.tunPolicy
+		for _, node := range set.servers() {
+			if policy.forceTCP {
+				node["network"] = "tcp"
+			}
+			applyIPFamily(node, opts.ipFamily, "bootstrap")
 		}
 
 		inbounds := []any{map[string]any{
 			"type":                  "tun",
 			"tag":                   "tun-in",
 			"interface_name":        opts.tunName,
-			"address":               splitCSV(opts.tunAddress),
+			"address":               tunAddresses(opts),
 			"mtu":                   opts.tunMTU,
 			"auto_route":            true,
 			"strict_route":          policy.strictRoute,
 			"stack":                 opts.tunStack,
-			"route_exclude_address": []string{"127.0.0.0/8", "::1/128"},
+			"route_exclude_address": tunExcludeAddresses(opts),
 		}}
 		if policy.autoRedirect {
 			tunInbound := inbounds[0].(map[string]any)
@@ -67,24 +198,108 @@ func buildSingBoxConfig(proxyOutbound map[string]any, opts options) map[string]a
 		}
 		config["inbounds"] = inbounds
 
-		dns, rules, resolver := buildTunDNSAndRules(proxyOutbound, opts, policy)
+		dns, rules, resolver := buildTunDNSAndRules(nodes, opts, policy)
 		config["dns"] = dns
-		route["rules"] = rules
+		route["rules"] = append(rules, opts.routing.routeRules()...)
 		route["default_domain_resolver"] = resolver
 	} else {
 		config["inbounds"] = []any{mixedInbound(opts)}
+		for _, node := range set.servers() {
+			applyIPFamily(node, opts.ipFamily, "local")
+		}
+		if dns := localDNSConfig(opts.ipFamily); dns != nil {
+			config["dns"] = dns
+		}
+		if rules := opts.routing.routeRules(); len(rules) > 0 {
+			// Sniffing recovers domains of SOCKS clients that connect by IP.
+			route["rules"] = append([]any{map[string]any{"action": "sniff"}}, rules...)
+		}
+	}
+	if sets := opts.routing.ruleSets(); len(sets) > 0 {
+		route["rule_set"] = sets
 	}
 
-	config["outbounds"] = []any{
-		proxyOutbound,
+	outbounds := make([]any, 0, len(set.groups)+len(nodes)+3)
+	if set.exit != nil {
+		outbounds = append(outbounds, set.exit)
+	}
+	for _, group := range set.groups {
+		outbounds = append(outbounds, group)
+	}
+	for _, node := range nodes {
+		outbounds = append(outbounds, node)
+	}
+	outbounds = append(outbounds,
 		map[string]any{"type": "direct", "tag": "direct"},
 		map[string]any{"type": "block", "tag": "block"},
-	}
+	)
+	config["outbounds"] = outbounds
 	config["route"] = route
 
+	experimental := map[string]any{}
+	if opts.clashAPI != "" {
+		clashAPI := map[string]any{"external_controller": opts.clashAPI}
+		if opts.clashSecret != "" {
+			clashAPI["secret"] = opts.clashSecret
+		}
+		experimental["clash_api"] = clashAPI
+	}
+	if opts.useTun && opts.tunFakeIP && opts.fakeIPCache != "" {
+		// Without the cache, fake IPs handed out before a restart point
+		// nowhere until the applications resolve again.
+		experimental["cache_file"] = map[string]any{
+			"enabled":      true,
+			"path":         opts.fakeIPCache,
+			"store_fakeip": true,
+		}
+	}
+	if len(experimental) > 0 {
+		config["experimental"] = experimental
+	}
+
 	return config
 }
 
+// urltestOutbound lets sing-box itself fail over between the group nodes,
+// periodically re-testing them against the urltest URL.
+func urltestOutbound(tag string, tags []string, opts options) map[string]any {
+	return map[string]any{
+		"type":      "urltest",
+		"tag":       tag,
+		"outbounds": tags,
+		"url":       opts.urltestURL,
+		"interval":  opts.urltestInterval.String(),
+		"tolerance": opts.urltestTolerance,
+	}
+}
+
+// tunAddresses adds the IPv6 address for --tun-ipv6 unless one is given.
+func tunAddresses(opts options) []string {
+	addresses := splitCSV(opts.tunAddress)
+	if opts.tunIPv6 && !hasIPv6Prefix(addresses) {
+		addresses = append(addresses, defaultTunAddress6)
+	}
+	return addresses
+}
+
+func hasIPv6Prefix(prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if ip, _, err := net.ParseCIDR(prefix); err == nil && ip.To4() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// tunExcludeAddresses lists the destinations that never enter the tunnel.
+func tunExcludeAddresses(opts options) []string {
+	excluded := []string{"127.0.0.0/8", "::1/128"}
+	if opts.tunBypassLAN {
+		excluded = append(excluded, lanRanges...)
+	}
+	return uniqueNonEmpty(append(excluded, splitCSV(opts.tunExclude)...))
+}
+
 func mixedInbound(opts options) map[string]any {
 	return map[string]any{
 		"type":        "mixed",
@@ -94,8 +309,42 @@ func mixedInbound(opts options) map[string]any {
 	}
 }
 
-func buildTunDNSAndRules(proxyOutbound map[string]any, opts options, policy tunPolicy) (map[string]any, []any, map[string]any) {
-	serverHost := strings.TrimSpace(fmt.Sprintf("%v", proxyOutbound["server"]))
+// applyIPFamily pins how the node address itself is resolved, so a node with
+// both A and AAAA records is reached over the family the user picked.
+func applyIPFamily(outbound map[string]any, family, resolverTag string) {
+	if family == "" || family == ipFamilyAuto {
+		return
+	}
+	if net.ParseIP(fmt.Sprintf("%v", outbound["server"])) != nil {
+		return
+	}
+	outbound["domain_resolver"] = map[string]any{
+		"server":   resolverTag,
+		"strategy": family,
+	}
+}
+
+// localDNSConfig provides the resolver referenced by applyIPFamily in mixed
+// mode, where the config otherwise has no DNS section.
+func localDNSConfig(family string) map[string]any {
+	if family == "" || family == ipFamilyAuto {
+		return nil
+	}
+	return map[string]any{
+		"servers":  []any{map[string]any{"type": "local", "tag": "local"}},
+		"strategy": family,
+	}
+}
+
+func buildTunDNSAndRules(nodes []map[string]any, opts options, policy tunPolicy) (map[string]any, []any, map[string]any) {
+	var serverHosts []string
+	for _, node := range nodes {
+		host := strings.TrimSpace(fmt.Sprintf("%v", node["server"]))
+		if host != "" && net.ParseIP(host) == nil {
+			serverHosts = append(serverHosts, host)
+		}
+	}
+	serverHosts = uniqueNonEmpty(serverHosts)
 
 	routeRules := []any{
 		map[string]any{"action": "sniff"},
@@ -110,26 +359,72 @@ func buildTunDNSAndRules(proxyOutbound map[string]any, opts options, policy tunP
 		})
 	}
 
+	// Excluded routes keep LAN traffic out of the tunnel at the OS level;
+	// these rules also send it direct when it reaches sing-box anyway, e.g.
+	// through the mixed inbound or with auto_redirect.
+	if opts.tunBypassLAN {
+		routeRules = append(routeRules,
+			map[string]any{"ip_is_private": true, "outbound": "direct"},
+			map[string]any{"ip_cidr": []string{"100.64.0.0/10", "224.0.0.0/4", "ff00::/8"}, "outbound": "direct"},
+		)
+	}
+	if excluded := splitCSV(opts.tunExclude); len(excluded) > 0 {
+		routeRules = append(routeRules, map[string]any{"ip_cidr": excluded, "outbound": "direct"})
+	}
+
 	dnsRules := []any{}
-	if serverHost != "" && net.ParseIP(serverHost) == nil {
+	if len(serverHosts) > 0 {
 		dnsRules = append(dnsRules, map[string]any{
-			"domain": []string{serverHost},
+			"domain": serverHosts,
 			"server": "bootstrap",
 		})
 		routeRules = append(routeRules, map[string]any{
-			"domain":   []string{serverHost},
+			"domain":   serverHosts,
 			"outbound": "direct",
 		})
 	}
 
 	bootstrap := buildBootstrapDNSServer(opts.tunBootstrapDNS)
 	remote := buildRemoteDNSServer(opts.tunRemoteDNS, "bootstrap")
+	local := buildLocalDNSServer(opts.tunLocalDNS, "bootstrap")
+	servers := []any{bootstrap, remote, local}
+
+	// Domains routed direct are resolved without the VPN: the answer then
+	// matches the network the traffic actually leaves through. This also
+	// keeps them out of FakeIP, as fake addresses mean nothing to direct
+	// traffic.
+	dnsRules = append(dnsRules, opts.routing.userDNSRules()...)
+	dnsRules = append(dnsRules, opts.routing.dnsRules(ruleOutboundDirect, "local")...)
+	if opts.tunFakeIP {
+		queryTypes := []string{"A"}
+		fakeIP := map[string]any{
+			"type":        "fakeip",
+			"tag":         "fakeip",
+			"inet4_range": opts.fakeIPRange4,
+		}
+		if opts.tunIPv6 || hasIPv6Prefix(splitCSV(opts.tunAddress)) {
+			queryTypes = append(queryTypes, "AAAA")
+			fakeIP["inet6_range"] = opts.fakeIPRange6
+		}
+		dnsRules = append(dnsRules, map[string]any{
+			"query_type": queryTypes,
+			"server":     "fakeip",
+		})
+		servers = append(servers, fakeIP)
+	}
 	dns := map[string]any{
 		"strategy": policy.dnsStrategy,
-		"servers":  []any{bootstrap, remote},
+		"servers":  servers,
 		"rules":    dnsRules,
 		"final":    "remote",
 	}
+	if !opts.tunDNSCache {
+		dns["disable_cache"] = true
+	} else if opts.tunDNSIndependentCache {
+		// Separate caches per server, so an answer from the local resolver
+		// is never served for a query that should go through the VPN.
+		dns["independent_cache"] = true
+	}
 	defaultResolver := map[string]any{
 		"server":   "bootstrap",
 		"strategy": policy.dnsStrategy,
@@ -173,10 +468,55 @@ func buildRemoteDNSServer(raw, resolverTag string) map[string]any {
 	if raw == "" {
 		raw = defaultTunRemoteDNS
 	}
+	return buildDNSServer(raw, "remote", "proxy", resolverTag)
+}
+
+// buildLocalDNSServer is the resolver for domains that are routed direct:
+// the system resolver, DHCP, or a server queried without the VPN.
+func buildLocalDNSServer(raw, resolverTag string) map[string]any {
+	raw = strings.TrimSpace(raw)
+	switch strings.ToLower(raw) {
+	case "", "local":
+		return map[string]any{"type": "local", "tag": "local"}
+	case "dhcp":
+		return map[string]any{"type": "dhcp", "tag": "local"}
+	}
+	return buildDNSServer(raw, "local", "", resolverTag)
+}
+
+// validLocalDNS reports whether buildLocalDNSServer understands raw instead
+// of falling back to treating it as a DoH host.
+func validLocalDNS(raw string) bool {
+	raw = strings.TrimSpace(raw)
+	switch strings.ToLower(raw) {
+	case "local", "dhcp":
+		return true
+	}
+	if net.ParseIP(raw) != nil {
+		return true
+	}
+	uri, err := parseURL(raw)
+	if err != nil || uri == nil || uri.Hostname() == "" {
+		return false
+	}
+	switch strings.ToLower(uri.Scheme) {
+	case "https", "tls", "tcp", "udp", "quic", "h3", "http3":
+	default:
+		return false
+	}
+	if portRaw := uri.Port(); portRaw != "" {
+		port, err := strconv.Atoi(portRaw)
+		return err == nil && port >= 1 && port <= 65535
+	}
+	return true
+}
 
-	remote := map[string]any{
-		"tag":    "remote",
-		"detour": "proxy",
+// buildDNSServer parses a DNS server given as a URL (https://, tls://, ...)
+// or a bare address; detour is left out for direct queries.
+func buildDNSServer(raw, tag, detour, resolverTag string) map[string]any {
+	remote := map[string]any{"tag": tag}
+	if detour != "" {
+		remote["detour"] = detour
 	}
 
 	uri, err := parseURL(raw)
@@ -0,0 +1,30 @@
+package app
+
+import "testing"
+
+func TestValidLocalDNS(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want bool
+	}{
+		{"local", true},
+		{"DHCP", true},
+		{"192.168.1.1", true},
+		{"2001:db8::53", true},
+		{"udp://192.168.1.1:53", true},
+		{"https://dns.yandex.ru/dns-query", true},
+		{"tls://1.1.1.1", true},
+		{"h3://dns.google/dns-query", true},
+		{"", false},
+		{"junk", false},
+		{"192.168.1.1:53", false},
+		{"ftp://dns.example", false},
+		{"https://", false},
+		{"udp://1.1.1.1:99999", false},
+	}
+	for _, tt := range tests {
+		if got := validLocalDNS(tt.raw); got != tt.want {
+			t.Errorf("validLocalDNS(%q) = %v, want %v", tt.raw, got, tt.want)
+		}
+	}
+}
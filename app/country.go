@@ -0,0 +1,341 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// countryKeywords maps lower-case words found in node names to ISO 3166
+// codes. Only countries and cities that VPN providers commonly use are
+// listed; anything else is left to the flag or the GeoIP database.
+var countryKeywords = map[string]string{
+	"austria": "AT", "австрия": "AT", "vienna": "AT", "вена": "AT",
+	"australia": "AU", "австралия": "AU", "sydney": "AU",
+	"belgium": "BE", "бельгия": "BE", "brussels": "BE",
+	"bulgaria": "BG", "болгария": "BG", "sofia": "BG",
+	"brazil": "BR", "бразилия": "BR",
+	"canada": "CA", "канада": "CA", "toronto": "CA", "montreal": "CA",
+	"switzerland": "CH", "швейцария": "CH", "zurich": "CH",
+	"czech": "CZ", "czechia": "CZ", "чехия": "CZ", "prague": "CZ", "прага": "CZ",
+	"germany": "DE", "deutschland": "DE", "германия": "DE", "frankfurt": "DE", "франкфурт": "DE", "berlin": "DE", "берлин": "DE", "nuremberg": "DE",
+	"denmark": "DK", "дания": "DK",
+	"estonia": "EE", "эстония": "EE", "tallinn": "EE",
+	"spain": "ES", "испания": "ES", "madrid": "ES",
+	"finland": "FI", "финляндия": "FI", "helsinki": "FI", "хельсинки": "FI",
+	"france": "FR", "франция": "FR", "paris": "FR", "париж": "FR",
+	"uk": "GB", "britain": "GB", "england": "GB", "великобритания": "GB", "англия": "GB", "london": "GB", "лондон": "GB",
+	"georgia": "GE", "грузия": "GE", "tbilisi": "GE",
+	"hongkong": "HK", "гонконг": "HK",
+	"hungary": "HU", "венгрия": "HU",
+	"ireland": "IE", "ирландия": "IE", "dublin": "IE",
+	"israel": "IL", "израиль": "IL",
+	"india": "IN", "индия": "IN",
+	"italy": "IT", "италия": "IT", "milan": "IT", "милан": "IT",
+	"japan": "JP", "япония": "JP", "tokyo": "JP", "токио": "JP",
+	"korea": "KR", "корея": "KR", "seoul": "KR",
+	"kazakhstan": "KZ", "казахстан": "KZ", "almaty": "KZ", "алматы": "KZ",
+	"lithuania": "LT", "литва": "LT", "vilnius": "LT",
+	"latvia": "LV", "латвия": "LV", "riga": "LV", "рига": "LV",
+	"moldova": "MD", "молдова": "MD",
+	"netherlands": "NL", "holland": "NL", "нидерланды": "NL", "голландия": "NL", "amsterdam": "NL", "амстердам": "NL",
+	"norway": "NO", "норвегия": "NO", "oslo": "NO",
+	"poland": "PL", "польша": "PL", "warsaw": "PL", "варшава": "PL",
+	"portugal": "PT", "португалия": "PT", "lisbon": "PT",
+	"romania": "RO", "румыния": "RO", "bucharest": "RO",
+	"serbia": "RS", "сербия": "RS", "belgrade": "RS",
+	"russia": "RU", "россия": "RU", "moscow": "RU", "москва": "RU",
+	"sweden": "SE", "швеция": "SE", "stockholm": "SE", "стокгольм": "SE",
+	"singapore": "SG", "сингапур": "SG",
+	"turkey": "TR", "turkiye": "TR", "турция": "TR", "istanbul": "TR", "стамбул": "TR",
+	"taiwan": "TW", "тайвань": "TW",
+	"ukraine": "UA", "украина": "UA", "kyiv": "UA", "kiev": "UA", "киев": "UA",
+	"usa": "US", "america": "US", "сша": "US", "америка": "US", "new york": "US", "los angeles": "US", "chicago": "US", "dallas": "US", "miami": "US",
+	"uzbekistan": "UZ", "узбекистан": "UZ",
+	"uae": "AE", "emirates": "AE", "оаэ": "AE", "dubai": "AE", "дубай": "AE",
+}
+
+// multiWordKeywords are the keywords matched as a phrase rather than a word,
+// sorted so that a name always resolves to the same country.
+var multiWordKeywords = func() []string {
+	var keywords []string
+	for keyword := range countryKeywords {
+		if strings.Contains(keyword, " ") {
+			keywords = append(keywords, keyword)
+		}
+	}
+	sort.Strings(keywords)
+	return keywords
+}()
+
+// countryCodes are the codes accepted as a bare token in a name ("NL 1").
+var countryCodes = func() map[string]bool {
+	codes := map[string]bool{}
+	for _, code := range countryKeywords {
+		codes[code] = true
+	}
+	return codes
+}()
+
+// assignCountries fills the country of every entry: a flag emoji in the name
+// wins, then a country or city keyword, then the GeoIP database for servers
+// given by IP. Host names need DNS and are left to probeEntriesCountry.
+func assignCountries(entries []proxyEntry, db *geoIPDB) {
+	for i := range entries {
+		entries[i].country = countryFromName(entries[i].name)
+		if entries[i].country != "" || entries[i].uri == nil || db == nil {
+			continue
+		}
+		if ip := net.ParseIP(entries[i].uri.Hostname()); ip != nil {
+			entries[i].country = db.lookup(ip)
+		}
+	}
+}
+
+// probeEntriesCountry resolves the server names of nodes still without a
+// country and looks them up in the GeoIP database. It is a probe stage so
+// that DNS does not hold up the menu.
+func probeEntriesCountry(ctx context.Context, board *probeBoard, opts options) {
+	if opts.geoIP == nil {
+		return
+	}
+	entries, indexes := board.stage()
+	var candidates []int
+	for _, i := range indexes {
+		if entries[i].country == "" && entries[i].uri != nil && net.ParseIP(entries[i].uri.Hostname()) == nil {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		return
+	}
+
+	progress := board.newProgress("GeoIP", len(candidates))
+	runProbePool(ctx, candidates, geoIPLookupWorkers,
+		func(idx int) string {
+			return opts.geoIP.lookupHost(ctx, entries[idx].uri.Hostname())
+		},
+		func(idx int, country string) {
+			if country != "" {
+				board.update(func(entries []proxyEntry) {
+					entries[idx].country = country
+				})
+			}
+			progress.record(country != "", entries[idx].name, 0)
+		},
+	)
+	progress.finish()
+}
+
+func countryFromName(name string) string {
+	if code := countryFromFlag(name); code != "" {
+		return code
+	}
+
+	lower := strings.ToLower(name)
+	words := strings.FieldsFunc(lower, func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	for _, word := range words {
+		if code, ok := countryKeywords[word]; ok {
+			return code
+		}
+	}
+	for _, keyword := range multiWordKeywords {
+		if strings.Contains(lower, keyword) {
+			return countryKeywords[keyword]
+		}
+	}
+	for _, word := range strings.FieldsFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r)
+	}) {
+		if len(word) == 2 && strings.ToUpper(word) == word && countryCodes[word] {
+			return word
+		}
+	}
+	return ""
+}
+
+// countryFromFlag decodes the first flag emoji, i.e. a pair of regional
+// indicator symbols.
+func countryFromFlag(name string) string {
+	runes := []rune(name)
+	for i := 0; i+1 < len(runes); i++ {
+		if isRegionalIndicator(runes[i]) && isRegionalIndicator(runes[i+1]) {
+			return string([]rune{runes[i] - 0x1F1E6 + 'A', runes[i+1] - 0x1F1E6 + 'A'})
+		}
+	}
+	return ""
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+// filterByCountry keeps the entries of the given countries; an empty list
+// keeps everything.
+func filterByCountry(entries []proxyEntry, countries []string) []proxyEntry {
+	if len(countries) == 0 {
+		return entries
+	}
+	wanted := map[string]bool{}
+	for _, country := range countries {
+		wanted[strings.ToUpper(country)] = true
+	}
+	var filtered []proxyEntry
+	for _, entry := range entries {
+		if wanted[entryCountry(entry)] {
+			filtered = append(filtered, entry)
+		}
+	}
+	return filtered
+}
+
+// entryCountry falls back to the measured exit country when the name and the
+// GeoIP database gave nothing.
+func entryCountry(entry proxyEntry) string {
+	if entry.country != "" {
+		return entry.country
+	}
+	return entry.exitCountry
+}
+
+// geoIPDB is an offline IP-to-country table loaded from a CSV file with
+// "first_ip,last_ip,country_code" rows. Addresses are either IPs, as in the
+// free DB-IP country database, or decimal integers, as in IP2Location LITE
+// DB1 (IPv4 and IPv6 editions).
+type geoIPDB struct {
+	ranges []geoIPRange
+}
+
+type geoIPRange struct {
+	first   net.IP
+	last    net.IP
+	country string
+}
+
+// geoIPLookupWorkers bounds the parallel DNS lookups of server names.
+const geoIPLookupWorkers = 16
+
+// loadGeoIPDB parses the database at path. It is loaded once into options,
+// so a subscription refresh from the menu reuses the table.
+func loadGeoIPDB(path string) (*geoIPDB, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("чтение GeoIP базы: %w", err)
+	}
+	db := &geoIPDB{}
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ",")
+		if len(fields) < 3 {
+			continue
+		}
+		for i := range fields {
+			fields[i] = strings.Trim(strings.TrimSpace(fields[i]), `"`)
+		}
+		first := parseGeoIPAddr(fields[0])
+		last := parseGeoIPAddr(fields[1])
+		country := strings.ToUpper(fields[2])
+		if first == nil || last == nil || len(country) != 2 || country == "ZZ" || country == "--" {
+			continue
+		}
+		db.ranges = append(db.ranges, geoIPRange{first: first, last: last, country: country})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("разбор GeoIP базы: %w", err)
+	}
+	if len(db.ranges) == 0 {
+		return nil, fmt.Errorf("в GeoIP базе %s нет диапазонов (ожидается CSV first_ip,last_ip,country)", path)
+	}
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return bytes.Compare(db.ranges[i].first, db.ranges[j].first) < 0
+	})
+	return db, nil
+}
+
+// parseGeoIPAddr returns the 16-byte form of an IP or of its decimal integer
+// value. Integers up to 32 bits are IPv4; larger ones are IPv6, where IPv4
+// is stored mapped (::ffff:a.b.c.d) and so lands on the same 16 bytes.
+func parseGeoIPAddr(field string) net.IP {
+	if ip := net.ParseIP(field); ip != nil {
+		return ip.To16()
+	}
+	n, ok := new(big.Int).SetString(field, 10)
+	if !ok || n.Sign() < 0 || n.BitLen() > 128 {
+		return nil
+	}
+	if n.BitLen() <= 32 {
+		ip := make(net.IP, net.IPv4len)
+		n.FillBytes(ip)
+		return ip.To16()
+	}
+	ip := make(net.IP, net.IPv6len)
+	n.FillBytes(ip)
+	return ip
+}
+
+func (db *geoIPDB) lookup(ip net.IP) string {
+	ip = ip.To16()
+	if ip == nil {
+		return ""
+	}
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return bytes.Compare(db.ranges[i].first, ip) > 0
+	})
+	if i == 0 {
+		return ""
+	}
+	r := db.ranges[i-1]
+	if bytes.Compare(ip, r.last) > 0 {
+		return ""
+	}
+	return r.country
+}
+
+// lookupHost resolves host names with a short timeout; a node whose name
+// does not resolve just stays without a country.
+func (db *geoIPDB) lookupHost(ctx context.Context, host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		return db.lookup(ip)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return ""
+	}
+	for _, addr := range addrs {
+		if country := db.lookup(addr.IP); country != "" {
+			return country
+		}
+	}
+	return ""
+}
+
+// groupByCountry keeps nodes of one country together. Groups are ordered by
+// their best node and keep the ranking inside, nodes without a country last.
+func groupByCountry(entries []proxyEntry) {
+	first := map[string]int{}
+	for i, entry := range entries {
+		if _, ok := first[entryCountry(entry)]; !ok {
+			first[entryCountry(entry)] = i
+		}
+	}
+	first[""] = len(entries)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return first[entryCountry(entries[i])] < first[entryCountry(entries[j])]
+	})
+}
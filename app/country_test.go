@@ -0,0 +1,126 @@
+package app
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCountryFromName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"🇩🇪 Germany WS", "DE"},
+		{"Amsterdam #2", "NL"},
+		{"Москва-1", "RU"},
+		{"NL 1", "NL"},
+		{"New York premium", "US"},
+		{"Los Angeles 10G", "US"},
+		{"nl lowercase code", ""},
+		{"Node 7", ""},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			if got := countryFromName(tt.name); got != tt.want {
+				t.Fatalf("countryFromName(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestParseGeoIPAddr(t *testing.T) {
+	tests := []struct {
+		field string
+		want  string
+	}{
+		{"1.2.3.4", "1.2.3.4"},
+		{"16909060", "1.2.3.4"},
+		{"0", "0.0.0.0"},
+		{"281470698652420", "1.2.3.4"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"42540766411282592856903984951653826561", "2001:db8::1"},
+		{"-1", ""},
+		{"not an ip", ""},
+	}
+	for _, tt := range tests {
+		got := parseGeoIPAddr(tt.field)
+		if tt.want == "" {
+			if got != nil {
+				t.Errorf("parseGeoIPAddr(%q) = %v, want nil", tt.field, got)
+			}
+			continue
+		}
+		if !got.Equal(net.ParseIP(tt.want)) {
+			t.Errorf("parseGeoIPAddr(%q) = %v, want %s", tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestLoadGeoIPDBFormats(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"dbip.csv":         "1.0.0.0,1.0.0.255,AU\n2001:db8::,2001:db8::ffff,NL\n",
+		"ip2location.csv":  "\"16777216\",\"16777471\",\"AU\",\"Australia\"\n\"0\",\"16777215\",\"-\",\"-\"\n",
+		"ip2location6.csv": "\"281470698520576\",\"281470698520831\",\"AU\",\"Australia\"\n\"42540766411282592856903984951653826560\",\"42540766411282592856903984951653892095\",\"NL\",\"Netherlands\"\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		db, err := loadGeoIPDB(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := db.lookup(net.ParseIP("1.0.0.7")); got != "AU" {
+			t.Errorf("%s: lookup(1.0.0.7) = %q, want AU", name, got)
+		}
+		if got := db.lookup(net.ParseIP("8.8.8.8")); got != "" {
+			t.Errorf("%s: lookup(8.8.8.8) = %q, want none", name, got)
+		}
+		if name != "ip2location.csv" {
+			if got := db.lookup(net.ParseIP("2001:db8::42")); got != "NL" {
+				t.Errorf("%s: lookup(2001:db8::42) = %q, want NL", name, got)
+			}
+		}
+	}
+}
+
+func TestCountriesFromGeoIP(t *testing.T) {
+	db := &geoIPDB{ranges: []geoIPRange{
+		{first: net.ParseIP("127.0.0.0").To16(), last: net.ParseIP("127.255.255.255").To16(), country: "DE"},
+	}}
+	entry := func(name, server string) proxyEntry {
+		uri, err := url.Parse("vless://id@" + server + ":443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return proxyEntry{raw: name, name: name, uri: uri}
+	}
+	entries := []proxyEntry{
+		entry("node 1", "127.0.0.2"),
+		entry("node 2", "localhost"),
+		entry("Amsterdam", "localhost"),
+		entry("node 3", "host.invalid"),
+	}
+
+	// Only the name and the IP server are known before the menu opens.
+	assignCountries(entries, db)
+	if got := []string{entries[0].country, entries[1].country, entries[2].country}; got[0] != "DE" || got[1] != "" || got[2] != "NL" {
+		t.Fatalf("countries before lookup = %v, want [DE  NL]", got)
+	}
+
+	board := newProbeBoard(entries, false)
+	probeEntriesCountry(context.Background(), board, options{geoIP: db})
+	resolved, _ := board.snapshot()
+	want := []string{"DE", "DE", "NL", ""}
+	for i, entry := range resolved {
+		if entry.country != want[i] {
+			t.Errorf("%s: country = %q, want %q", entry.name, entry.country, want[i])
+		}
+	}
+}
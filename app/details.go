@@ -0,0 +1,205 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// detailLine is one labelled row of the menu details pane.
+type detailLine struct {
+	label string
+	value string
+}
+
+// entryDetails describes the highlighted node from its parsed outbound, i.e.
+// exactly what would be written into the sing-box config, plus every probe
+// result. It always returns the same labels so the pane keeps its height
+// while the cursor moves.
+func entryDetails(entry proxyEntry) []detailLine {
+	outbound, err := buildVLESSOutbound(entry.uri)
+	if err != nil {
+		outbound = map[string]any{}
+	}
+	tlsConfig, _ := outbound["tls"].(map[string]any)
+	transport, _ := outbound["transport"].(map[string]any)
+
+	lines := []detailLine{
+		{"Узел", fmt.Sprintf("%s (ID %s)", displayName(entry), entry.id)},
+		{"Адрес", detailAddress(outbound)},
+		{"Страна", detailCountry(entry)},
+		{"Транспорт", detailTransport(transport)},
+		{"Безопасность", detailSecurity(tlsConfig)},
+		{"Flow", detailString(outbound["flow"])},
+		{"RTT", detailRTT(entry)},
+		{"HTTP", detailHTTP(entry)},
+		{"UDP", detailUDP(entry)},
+		{"Скорость", formatSpeedStatus(entry)},
+		{"Exit IP", formatExitStatus(entry)},
+		{"Надежность", detailReliability(entry)},
+	}
+	for i := range lines {
+		if strings.TrimSpace(lines[i].value) == "" {
+			lines[i].value = "--"
+		}
+	}
+	return lines
+}
+
+func detailAddress(outbound map[string]any) string {
+	server := detailString(outbound["server"])
+	if server == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s port %v", server, outbound["server_port"])
+}
+
+func detailCountry(entry proxyEntry) string {
+	if entry.exitCountry != "" && entry.country != "" && entry.exitCountry != entry.country {
+		return fmt.Sprintf("%s (exit IP: %s)", entry.country, entry.exitCountry)
+	}
+	return entryCountry(entry)
+}
+
+func detailTransport(transport map[string]any) string {
+	if transport == nil {
+		return "tcp"
+	}
+	parts := []string{detailString(transport["type"])}
+	for _, key := range []string{"path", "service_name", "host", "authority"} {
+		if value := detailString(transport[key]); value != "" {
+			parts = append(parts, fmt.Sprintf("%s=%s", key, value))
+		}
+	}
+	if headers, ok := transport["headers"].(map[string]any); ok {
+		if host := detailString(headers["Host"]); host != "" {
+			parts = append(parts, "host="+host)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func detailSecurity(tlsConfig map[string]any) string {
+	if tlsConfig == nil {
+		return "none"
+	}
+	parts := []string{"tls"}
+	if reality, ok := tlsConfig["reality"].(map[string]any); ok {
+		parts[0] = "reality"
+		parts = append(parts, "pbk="+clipRunes(detailString(reality["public_key"]), 12))
+		if sid := detailString(reality["short_id"]); sid != "" {
+			parts = append(parts, "sid="+sid)
+		}
+	}
+	if sni := detailString(tlsConfig["server_name"]); sni != "" {
+		parts = append(parts, "sni="+sni)
+	}
+	if utls, ok := tlsConfig["utls"].(map[string]any); ok {
+		parts = append(parts, "fp="+detailString(utls["fingerprint"]))
+	}
+	if alpn := detailString(tlsConfig["alpn"]); alpn != "" {
+		parts = append(parts, "alpn="+alpn)
+	}
+	if insecure, _ := tlsConfig["insecure"].(bool); insecure {
+		parts = append(parts, "insecure")
+	}
+	return strings.Join(parts, " ")
+}
+
+func detailRTT(entry proxyEntry) string {
+	if !entry.tested {
+		return ""
+	}
+	text := detailStats(entry.rttStats)
+	if entry.probeErr != "" {
+		text = detailError(entry.probeErr, entry.probeErrDetail)
+	}
+	var families []string
+	for _, family := range []struct {
+		label string
+		stats probeStats
+	}{{"v4", entry.rtt4}, {"v6", entry.rtt6}} {
+		if family.stats.samples == 0 {
+			continue
+		}
+		if family.stats.failures == family.stats.samples {
+			families = append(families, family.label+" fail")
+			continue
+		}
+		families = append(families, fmt.Sprintf("%s %s", family.label, formatDetailDuration(family.stats.median)))
+	}
+	if len(families) > 0 {
+		text += " [" + strings.Join(families, ", ") + "]"
+	}
+	return text
+}
+
+func detailHTTP(entry proxyEntry) string {
+	if !entry.httpTested {
+		return ""
+	}
+	if !entry.httpOK {
+		return detailError(entry.httpErr, entry.httpErrDetail)
+	}
+	return fmt.Sprintf("HTTP %d, %s", entry.httpStatus, detailStats(entry.httpStats))
+}
+
+func detailUDP(entry proxyEntry) string {
+	if !entry.udpTested {
+		return ""
+	}
+	if !entry.udpOK {
+		return formatUDPStatus(entry)
+	}
+	return detailStats(entry.udpStats)
+}
+
+func detailReliability(entry proxyEntry) string {
+	if !entry.historyScored {
+		return ""
+	}
+	return fmt.Sprintf("%s (проверок в истории: %d)", formatReliability(entry), entry.historyRecords)
+}
+
+func detailStats(stats probeStats) string {
+	if stats.samples <= 1 {
+		return formatDetailDuration(stats.median)
+	}
+	return fmt.Sprintf("медиана %s, min %s, p95 %s, джиттер %s, потери %s из %d",
+		formatDetailDuration(stats.median),
+		formatDetailDuration(stats.min),
+		formatDetailDuration(stats.p95),
+		formatDetailDuration(stats.jitter),
+		formatLoss(stats),
+		stats.samples,
+	)
+}
+
+func detailError(code, detail string) string {
+	detail = strings.Join(strings.Fields(detail), " ")
+	if detail == "" || detail == code {
+		return code
+	}
+	return code + ": " + detail
+}
+
+func detailString(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []string:
+		return strings.Join(v, ",")
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+func formatDetailDuration(d time.Duration) string {
+	ms := d.Milliseconds()
+	if ms < 1 && d > 0 {
+		ms = 1
+	}
+	return fmt.Sprintf("%dms", ms)
+}
@@ -0,0 +1,152 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+type exitIPInfo struct {
+	ip      string
+	country string
+}
+
+type exitIPOutcome struct {
+	info exitIPInfo
+	err  error
+}
+
+func probeEntriesExitIP(ctx context.Context, board *probeBoard, opts options) {
+	entries, indexes := board.stage()
+	var candidates []int
+	for _, i := range indexes {
+		if healthBucket(entries[i]) < 2 {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		return
+	}
+
+	if _, err := exec.LookPath(opts.singBoxBinary); err != nil {
+		board.update(func(entries []proxyEntry) {
+			for _, idx := range candidates {
+				entries[idx].exitTested = true
+				entries[idx].exitErr = "skip"
+			}
+		})
+		return
+	}
+
+	direct, err := fetchExitIP(ctx, newDirectHTTPClient(), opts.exitIPURL, opts.healthTimeout)
+	if err != nil {
+		board.logf("Не удалось определить прямой IP (%v), проверка утечек отключена", err)
+	}
+
+	progress := board.newProgress("Exit IP", len(candidates))
+	runProbePool(ctx, candidates, opts.healthWorkers,
+		func(idx int) exitIPOutcome {
+			info, err := probeEntryExitIP(ctx, entries[idx], opts)
+			return exitIPOutcome{info: info, err: err}
+		},
+		func(idx int, res exitIPOutcome) {
+			if res.err != nil && ctx.Err() != nil {
+				return
+			}
+			board.update(func(entries []proxyEntry) {
+				entries[idx].exitTested = true
+				if res.err != nil {
+					entries[idx].exitErr = normalizeHTTPProbeError(res.err)
+					return
+				}
+				entries[idx].exitIP = res.info.ip
+				entries[idx].exitCountry = res.info.country
+				entries[idx].exitLeak = direct.ip != "" && res.info.ip == direct.ip
+			})
+			progress.record(res.err == nil, entries[idx].name, 0)
+		},
+	)
+	progress.finish()
+}
+
+func probeEntryExitIP(ctx context.Context, entry proxyEntry, opts options) (exitIPInfo, error) {
+	proxy, err := startProbeProxy(ctx, entry, opts, opts.healthTimeout+4*time.Second, probeTrafficTCP)
+	if err != nil {
+		return exitIPInfo{}, err
+	}
+	defer proxy.stop()
+
+	return fetchExitIP(ctx, newProxyHTTPClient(proxy.addr), opts.exitIPURL, opts.healthTimeout)
+}
+
+func fetchExitIP(ctx context.Context, client *http.Client, requestURL string, timeout time.Duration) (exitIPInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return exitIPInfo{}, err
+	}
+	req.Header.Set("User-Agent", "subbox-exit-ip/1.0")
+	req.Header.Set("Accept", "application/json, text/plain")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return exitIPInfo{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return exitIPInfo{}, fmt.Errorf("exit-ip-url вернул HTTP %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return exitIPInfo{}, err
+	}
+	return parseExitIPResponse(body)
+}
+
+// parseExitIPResponse understands plain-text endpoints (api.ipify.org,
+// ifconfig.me) and the JSON shapes of the common geolocation services
+// (ipinfo.io, ip-api.com, ipapi.co, ifconfig.co).
+func parseExitIPResponse(body []byte) (exitIPInfo, error) {
+	text := strings.TrimSpace(string(body))
+	if ip := net.ParseIP(text); ip != nil {
+		return exitIPInfo{ip: ip.String()}, nil
+	}
+
+	var payload map[string]any
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return exitIPInfo{}, errors.New("exit-ip-url вернул ответ без IP")
+	}
+
+	info := exitIPInfo{}
+	for _, key := range []string{"ip", "query", "ip_addr", "origin", "address"} {
+		if raw, ok := payload[key].(string); ok {
+			if ip := net.ParseIP(strings.TrimSpace(raw)); ip != nil {
+				info.ip = ip.String()
+				break
+			}
+		}
+	}
+	if info.ip == "" {
+		return exitIPInfo{}, errors.New("exit-ip-url вернул ответ без IP")
+	}
+
+	for _, key := range []string{"country_code", "countryCode", "country_iso", "country"} {
+		if raw, ok := payload[key].(string); ok {
+			if code := strings.TrimSpace(raw); len(code) == 2 {
+				info.country = strings.ToUpper(code)
+				break
+			}
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,50 @@
+package app
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNewDirectHTTPClientIgnoresProxyEnv(t *testing.T) {
+	t.Setenv("HTTPS_PROXY", "http://proxy.invalid:3128")
+	t.Setenv("HTTP_PROXY", "http://proxy.invalid:3128")
+
+	transport, ok := newDirectHTTPClient().Transport.(*http.Transport)
+	if !ok {
+		t.Fatal("direct client must use its own transport, not the default one")
+	}
+	if transport.Proxy != nil {
+		t.Error("direct client must not resolve a proxy from the environment")
+	}
+}
+
+func TestParseExitIPResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    exitIPInfo
+		wantErr bool
+	}{
+		{"plain text", "203.0.113.5\n", exitIPInfo{ip: "203.0.113.5"}, false},
+		{"plain ipv6", "2001:DB8::1", exitIPInfo{ip: "2001:db8::1"}, false},
+		{"ipinfo", `{"ip":"203.0.113.5","country":"DE"}`, exitIPInfo{ip: "203.0.113.5", country: "DE"}, false},
+		{"ip-api", `{"query":"203.0.113.5","country":"Germany","countryCode":"de"}`, exitIPInfo{ip: "203.0.113.5", country: "DE"}, false},
+		{"ifconfig.co", `{"ip":"203.0.113.5","country":"Germany","country_iso":"DE"}`, exitIPInfo{ip: "203.0.113.5", country: "DE"}, false},
+		{"no country", `{"ip_addr":"203.0.113.5"}`, exitIPInfo{ip: "203.0.113.5"}, false},
+		{"invalid ip skipped", `{"ip":"unknown","origin":"203.0.113.5"}`, exitIPInfo{ip: "203.0.113.5"}, false},
+		{"json without ip", `{"country":"DE"}`, exitIPInfo{}, true},
+		{"html", "<html>blocked</html>", exitIPInfo{}, true},
+		{"empty", "", exitIPInfo{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseExitIPResponse([]byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseExitIPResponse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	historyVersion      = 1
+	historyMaxAge       = 30 * 24 * time.Hour
+	historyMaxRecords   = 500
+	historyMinRecords   = 3
+	historyHalfLife     = 7 * 24 * time.Hour
+	historyNeutralScore = 0.5
+)
+
+// probeHistory keys nodes by node ID rather than the canonical key, which
+// carries the node credential.
+type probeHistory struct {
+	Version int                     `json:"version"`
+	Nodes   map[string]*nodeHistory `json:"nodes"`
+}
+
+type nodeHistory struct {
+	Name    string          `json:"name"`
+	Records []historyRecord `json:"records"`
+}
+
+type historyRecord struct {
+	Time       time.Time `json:"time"`
+	RTTTested  bool      `json:"rtt_tested,omitempty"`
+	RTTOK      bool      `json:"rtt_ok,omitempty"`
+	RTTMillis  int64     `json:"rtt_ms,omitempty"`
+	HTTPTested bool      `json:"http_tested,omitempty"`
+	HTTPOK     bool      `json:"http_ok,omitempty"`
+	HTTPMillis int64     `json:"http_ms,omitempty"`
+}
+
+func defaultHistoryPath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil || dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, "subbox", "history.json")
+}
+
+// recordProbeHistory appends this run's probe results of the entries at
+// indexes to the history file and returns the updated history for scoring.
+// It does disk I/O, so callers pass a snapshot rather than holding the board.
+func recordProbeHistory(entries []proxyEntry, indexes []int, path string, now time.Time) (*probeHistory, error) {
+	history, err := loadProbeHistory(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, i := range indexes {
+		record, ok := historyRecordFor(entries[i], now)
+		if !ok {
+			continue
+		}
+		node := history.Nodes[entries[i].id]
+		if node == nil {
+			node = &nodeHistory{}
+			history.Nodes[entries[i].id] = node
+		}
+		node.Name = entries[i].name
+		node.Records = append(node.Records, record)
+	}
+	history.prune(now)
+
+	return history, saveProbeHistory(path, history)
+}
+
+func historyRecordFor(entry proxyEntry, now time.Time) (historyRecord, bool) {
+	record := historyRecord{Time: now}
+	if entry.tested {
+		record.RTTTested = true
+		record.RTTOK = entry.probeErr == ""
+		if record.RTTOK {
+			record.RTTMillis = entry.latency.Milliseconds()
+		}
+	}
+	if entry.httpTested && entry.httpErr != "skip" {
+		record.HTTPTested = true
+		record.HTTPOK = entry.httpOK
+		if entry.httpOK {
+			record.HTTPMillis = entry.httpLatency.Milliseconds()
+		}
+	}
+	return record, record.RTTTested || record.HTTPTested
+}
+
+func loadProbeHistory(path string) (*probeHistory, error) {
+	history := &probeHistory{Version: historyVersion, Nodes: map[string]*nodeHistory{}}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return history, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("чтение %s: %w", path, err)
+	}
+	if err := json.Unmarshal(raw, history); err != nil {
+		return nil, fmt.Errorf("разбор %s: %w", path, err)
+	}
+	if history.Nodes == nil {
+		history.Nodes = map[string]*nodeHistory{}
+	}
+	return history, nil
+}
+
+func saveProbeHistory(path string, history *probeHistory) error {
+	history.Version = historyVersion
+	raw, err := json.Marshal(history)
+	if err != nil {
+		return fmt.Errorf("marshal history: %w", err)
+	}
+	return writeFileAtomic(path, raw)
+}
+
+// writeFileAtomic replaces path via a temp file in the same directory so an
+// interrupted run never leaves a truncated file behind.
+func writeFileAtomic(path string, raw []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("создание %s: %w", dir, err)
+	}
+	file, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("создание temp файла: %w", err)
+	}
+	tmpPath := file.Name()
+	if _, err := file.Write(raw); err != nil {
+		_ = file.Close()
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("запись %s: %w", tmpPath, err)
+	}
+	if err := file.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("закрытие %s: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("запись %s: %w", path, err)
+	}
+	return nil
+}
+
+func (h *probeHistory) prune(now time.Time) {
+	for key, node := range h.Nodes {
+		kept := node.Records[:0]
+		for _, record := range node.Records {
+			if now.Sub(record.Time) <= historyMaxAge {
+				kept = append(kept, record)
+			}
+		}
+		if len(kept) > historyMaxRecords {
+			kept = kept[len(kept)-historyMaxRecords:]
+		}
+		if len(kept) == 0 {
+			delete(h.Nodes, key)
+			continue
+		}
+		node.Records = kept
+	}
+}
+
+func scoreEntries(entries []proxyEntry, history *probeHistory, now time.Time) {
+	for i := range entries {
+		entries[i].historyScored = true
+		entries[i].reliability = historyNeutralScore
+		entries[i].historyRecords = 0
+
+		node := history.Nodes[entries[i].id]
+		if node == nil {
+			continue
+		}
+		entries[i].historyRecords = len(node.Records)
+		if len(node.Records) >= historyMinRecords {
+			entries[i].reliability = reliabilityScore(node.Records, now)
+		}
+	}
+}
+
+// reliabilityScore is the recency-weighted success rate of a node, reduced
+// when its latency over the last day is worse than its longer-term median.
+func reliabilityScore(records []historyRecord, now time.Time) float64 {
+	var total, success float64
+	var recent, older []time.Duration
+	for _, record := range records {
+		age := now.Sub(record.Time)
+		weight := math.Pow(0.5, float64(age)/float64(historyHalfLife))
+		total += weight
+		ok, latency := record.outcome()
+		if !ok {
+			continue
+		}
+		success += weight
+		if age <= 24*time.Hour {
+			recent = append(recent, latency)
+		} else {
+			older = append(older, latency)
+		}
+	}
+	if total == 0 {
+		return historyNeutralScore
+	}
+
+	score := success / total
+	if len(recent) > 0 && len(older) > 0 {
+		recentMedian := medianDuration(recent)
+		olderMedian := medianDuration(older)
+		if recentMedian > olderMedian && recentMedian > 0 {
+			trend := float64(olderMedian) / float64(recentMedian)
+			if trend < 0.5 {
+				trend = 0.5
+			}
+			score *= trend
+		}
+	}
+	return score
+}
+
+// outcome prefers the HTTP result when the node was health-checked, since a
+// TCP connect alone does not prove the node forwards traffic.
+func (r historyRecord) outcome() (bool, time.Duration) {
+	if r.HTTPTested {
+		return r.HTTPOK, time.Duration(r.HTTPMillis) * time.Millisecond
+	}
+	return r.RTTOK, time.Duration(r.RTTMillis) * time.Millisecond
+}
+
+func medianDuration(values []time.Duration) time.Duration {
+	sorted := append([]time.Duration(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return percentileDuration(sorted, 50)
+}
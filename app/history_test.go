@@ -0,0 +1,63 @@
+package app
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordProbeHistoryKeysByID(t *testing.T) {
+	key := "vless://11111111-1111-1111-1111-111111111111@example.com:443?security=tls"
+	path := filepath.Join(t.TempDir(), "history.json")
+	entries := []proxyEntry{{key: key, id: nodeID(key), name: "NL", probeResults: probeResults{tested: true, latency: 5 * time.Millisecond}}}
+
+	if _, err := recordProbeHistory(entries, []int{0}, path, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	history, err := loadProbeHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node := history.Nodes[nodeID(key)]; node == nil || len(node.Records) != 1 {
+		t.Fatalf("node not keyed by ID: %+v", history.Nodes)
+	}
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(saved), "11111111-1111") {
+		t.Errorf("saved history contains the node UUID: %s", saved)
+	}
+}
+
+func TestReliabilityScore(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	rtt := func(age time.Duration, ok bool, millis int64) historyRecord {
+		return historyRecord{Time: now.Add(-age), RTTTested: true, RTTOK: ok, RTTMillis: millis}
+	}
+	tests := []struct {
+		name    string
+		records []historyRecord
+		want    float64
+	}{
+		{"no records", nil, historyNeutralScore},
+		{"all ok", []historyRecord{rtt(time.Hour, true, 50), rtt(2*time.Hour, true, 50)}, 1},
+		{"half failed", []historyRecord{rtt(time.Hour, true, 50), rtt(time.Hour, false, 0)}, 0.5},
+		// A failure one half-life ago weighs half as much as a fresh success.
+		{"old failure", []historyRecord{rtt(historyHalfLife, false, 0), rtt(0, true, 50)}, 1 / 1.5},
+		{"latency improved", []historyRecord{rtt(48*time.Hour, true, 200), rtt(time.Hour, true, 100)}, 1},
+		{"latency doubled", []historyRecord{rtt(48*time.Hour, true, 100), rtt(time.Hour, true, 200)}, 0.5},
+		{"trend floor", []historyRecord{rtt(48*time.Hour, true, 100), rtt(time.Hour, true, 1000)}, 0.5},
+		{"http preferred", []historyRecord{{Time: now, RTTTested: true, RTTOK: true, RTTMillis: 20, HTTPTested: true}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := reliabilityScore(tt.records, now); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("reliabilityScore() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
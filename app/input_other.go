@@ -0,0 +1,14 @@
+//go:build !unix && !windows
+
+package app
+
+import (
+	"os"
+	"time"
+)
+
+// waitForInput cannot wait on these platforms; the menu falls back to a
+// blocking read.
+func waitForInput(f *os.File, timeout time.Duration) (bool, error) {
+	return true, nil
+}
@@ -0,0 +1,50 @@
+//go:build windows
+
+package app
+
+import (
+	"os"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var procPeekConsoleInput = windows.NewLazySystemDLL("kernel32.dll").NewProc("PeekConsoleInputW")
+
+// inputRecord is the prefix of INPUT_RECORD that tells key presses apart.
+type inputRecord struct {
+	eventType uint16
+	_         uint16
+	keyDown   int32
+	_         [12]byte
+}
+
+// waitForInput reports whether the console behind f has a key press within
+// timeout. Key releases, focus and mouse events also wake the wait but give
+// Read nothing to return, so they are dropped here instead of leaving Read
+// blocked past the end of the menu session.
+func waitForInput(f *os.File, timeout time.Duration) (bool, error) {
+	handle := windows.Handle(f.Fd())
+	event, err := windows.WaitForSingleObject(handle, uint32(timeout/time.Millisecond))
+	if err != nil {
+		return false, err
+	}
+	if event != windows.WAIT_OBJECT_0 {
+		return false, nil
+	}
+
+	var records [16]inputRecord
+	var n uint32
+	ok, _, _ := procPeekConsoleInput.Call(uintptr(handle), uintptr(unsafe.Pointer(&records[0])), uintptr(len(records)), uintptr(unsafe.Pointer(&n)))
+	if ok == 0 || int(n) == len(records) {
+		return true, nil
+	}
+	for _, record := range records[:n] {
+		if record.eventType == windows.KEY_EVENT && record.keyDown != 0 {
+			return true, nil
+		}
+	}
+	_ = windows.FlushConsoleInputBuffer(handle)
+	return false, nil
+}
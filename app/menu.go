@@ -0,0 +1,669 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+const (
+	menuRedrawInterval = 100 * time.Millisecond
+	keyPollInterval    = 50 * time.Millisecond
+)
+
+var errMenuCancelled = errors.New("выбор отменен")
+
+type keyCode int
+
+const (
+	keyRune keyCode = iota
+	keyUp
+	keyDown
+	keyPageUp
+	keyPageDown
+	keyHome
+	keyEnd
+	keyEnter
+	keyEscape
+	keyBackspace
+	keyTab
+	keyCtrlC
+)
+
+type menuKey struct {
+	code keyCode
+	r    rune
+}
+
+// startKeyReader reads key presses from the terminal for one menu session.
+// It waits for input with a timeout instead of blocking in Read, so stop
+// ends it for good: a reader left behind would swallow the next key press,
+// or input meant for sing-box running in the foreground afterwards. stop
+// returns once the reader has exited.
+func startKeyReader(f *os.File) (<-chan menuKey, func()) {
+	out := make(chan menuKey, 16)
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		defer close(out)
+		buf := make([]byte, 256)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			ready, err := waitForInput(f, keyPollInterval)
+			if err != nil {
+				return
+			}
+			if !ready {
+				continue
+			}
+			n, err := f.Read(buf)
+			for _, key := range parseKeys(buf[:n]) {
+				select {
+				case out <- key:
+				case <-done:
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() { close(done) })
+		<-exited
+	}
+	return out, stop
+}
+
+// parseKeys decodes one read from a raw-mode terminal. Escape sequences are
+// assumed not to be split across reads, which holds for key presses.
+func parseKeys(data []byte) []menuKey {
+	var keys []menuKey
+	for i := 0; i < len(data); {
+		b := data[i]
+		switch {
+		case b == 0x1b:
+			if i+1 >= len(data) || (data[i+1] != '[' && data[i+1] != 'O') {
+				keys = append(keys, menuKey{code: keyEscape})
+				i++
+				continue
+			}
+			j := i + 2
+			for j < len(data) && ((data[j] >= '0' && data[j] <= '9') || data[j] == ';') {
+				j++
+			}
+			if j >= len(data) {
+				return keys
+			}
+			switch string(data[i+2 : j+1]) {
+			case "A":
+				keys = append(keys, menuKey{code: keyUp})
+			case "B":
+				keys = append(keys, menuKey{code: keyDown})
+			case "5~":
+				keys = append(keys, menuKey{code: keyPageUp})
+			case "6~":
+				keys = append(keys, menuKey{code: keyPageDown})
+			case "H", "1~", "7~":
+				keys = append(keys, menuKey{code: keyHome})
+			case "F", "4~", "8~":
+				keys = append(keys, menuKey{code: keyEnd})
+			}
+			i = j + 1
+		case b == '\r' || b == '\n':
+			keys = append(keys, menuKey{code: keyEnter})
+			i++
+		case b == 0x03:
+			keys = append(keys, menuKey{code: keyCtrlC})
+			i++
+		case b == 0x7f || b == 0x08:
+			keys = append(keys, menuKey{code: keyBackspace})
+			i++
+		case b == '\t':
+			keys = append(keys, menuKey{code: keyTab})
+			i++
+		case b < 0x20:
+			i++
+		default:
+			r, size := utf8.DecodeRune(data[i:])
+			keys = append(keys, menuKey{code: keyRune, r: r})
+			i += size
+		}
+	}
+	return keys
+}
+
+// liveMenu is the interactive node list. It renders snapshots of the probe
+// board and re-sorts them as results arrive; the highlighted node is tracked
+// by identity so it stays under the cursor while rows move around.
+//
+// It draws itself rather than using promptui: promptui.Select builds its list
+// once in Run and redraws only on a key press, so probe results streamed in
+// while it is open would not show, and its items cannot be re-sorted.
+type liveMenu struct {
+	board    *probeBoard
+	runner   *probeRunner
+	state    *userState
+	opts     options
+	withHTTP bool
+	sortMode string
+
+	items     []proxyEntry
+	matches   map[string]searchMatch
+	status    string
+	searching bool
+	query     string
+	details   bool
+	country   string
+	grouped   bool
+	marked    map[string]bool
+	cursor    int
+	cursorRaw string
+	followTop bool
+	offset    int
+	pageSize  int
+}
+
+func chooseEntryWithArrows(board *probeBoard, runner *probeRunner, state *userState, opts options) ([]proxyEntry, error) {
+	fd := int(os.Stdin.Fd())
+	termState, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, fmt.Errorf("переключение терминала: %w", err)
+	}
+	fmt.Print("\033[?1049h\033[?25l")
+	restore := func() {
+		fmt.Print("\033[?25h\033[?1049l")
+		_ = term.Restore(fd, termState)
+	}
+
+	menu := &liveMenu{
+		board:     board,
+		runner:    runner,
+		state:     state,
+		opts:      opts,
+		withHTTP:  opts.healthCheck && !opts.skipHTTP,
+		sortMode:  opts.sortBy,
+		marked:    map[string]bool{},
+		followTop: true,
+	}
+	// The last used node starts under the cursor instead of the best one.
+	items, _ := board.snapshot()
+	if last, ok := state.lastEntry(items); ok {
+		menu.cursorRaw = last.raw
+		menu.followTop = false
+	}
+	keys, stopKeys := startKeyReader(os.Stdin)
+	chosen, err := menu.run(keys)
+	stopKeys()
+	restore()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(chosen) == 1 {
+		fmt.Printf("Выбран: %s\n", renderMenuRow(chosen[0], menu.cursor, entryColumns(menu.items)))
+		return chosen, nil
+	}
+	fmt.Println("Выбрана группа:")
+	columns := entryColumns(chosen)
+	for i, entry := range chosen {
+		fmt.Printf("  %s\n", renderMenuRow(entry, i, columns))
+	}
+	return chosen, nil
+}
+
+func (m *liveMenu) run(keys <-chan menuKey) ([]proxyEntry, error) {
+	m.refresh()
+	m.render()
+
+	ticker := time.NewTicker(menuRedrawInterval)
+	defer ticker.Stop()
+
+	dirty := false
+	lastWidth, lastHeight := terminalSize()
+	for {
+		select {
+		case key, ok := <-keys:
+			if !ok {
+				return nil, errMenuCancelled
+			}
+			done, err := m.handleKey(key)
+			if err != nil {
+				return nil, err
+			}
+			if chosen := m.chosen(); done && len(chosen) > 0 {
+				return chosen, nil
+			}
+			m.render()
+		case <-m.board.changed:
+			dirty = true
+		case <-ticker.C:
+			width, height := terminalSize()
+			if !dirty && width == lastWidth && height == lastHeight {
+				continue
+			}
+			dirty = false
+			lastWidth, lastHeight = width, height
+			m.refresh()
+			m.render()
+		}
+	}
+}
+
+// refresh takes a fresh snapshot and puts the cursor back on the node it was
+// on. Until the user moves, the cursor follows the best-ranked node instead.
+func (m *liveMenu) refresh() {
+	items, status := m.board.snapshot()
+	sortEntries(items, m.sortMode, m.withHTTP)
+	if m.grouped {
+		groupByCountry(items)
+	}
+	if m.country != "" {
+		items = filterByCountry(items, []string{m.country})
+	}
+	m.items, m.matches = filterEntries(items, m.query)
+	m.status = status
+
+	m.cursor = 0
+	if !m.followTop {
+		for i, entry := range m.items {
+			if entry.raw == m.cursorRaw {
+				m.cursor = i
+				break
+			}
+		}
+	}
+	if len(m.items) > 0 {
+		m.cursorRaw = m.items[m.cursor].raw
+	}
+}
+
+func (m *liveMenu) handleKey(key menuKey) (bool, error) {
+	if m.searching {
+		if handled := m.handleSearchKey(key); handled {
+			return false, nil
+		}
+	}
+	switch key.code {
+	case keyUp:
+		m.move(-1)
+	case keyDown:
+		m.move(1)
+	case keyPageUp:
+		m.move(-m.pageSize)
+	case keyPageDown:
+		m.move(m.pageSize)
+	case keyHome:
+		m.move(-len(m.items))
+	case keyEnd:
+		m.move(len(m.items))
+	case keyEnter:
+		return true, nil
+	case keyCtrlC, keyEscape:
+		return false, errMenuCancelled
+	case keyRune:
+		switch key.r {
+		case 'k':
+			m.move(-1)
+		case 'j':
+			m.move(1)
+		case 'q':
+			return false, errMenuCancelled
+		case ' ':
+			m.toggleMark()
+		case 'f':
+			m.toggleFavorite()
+		case '/':
+			m.searching = true
+		case 'i':
+			m.details = !m.details
+		case 'r':
+			if len(m.items) > 0 {
+				m.runner.probe(map[string]bool{m.items[m.cursor].raw: true})
+			}
+		case 'R':
+			m.runner.probe(nil)
+		case 's':
+			m.cycleSort()
+		case 'u':
+			m.reloadSubscription()
+		case 'c':
+			m.cycleCountry()
+		case 'g':
+			m.grouped = !m.grouped
+			m.refresh()
+		}
+	}
+	return false, nil
+}
+
+// handleSearchKey edits the search query. Navigation, Enter and Ctrl+C are
+// left to handleKey so they work the same while searching.
+func (m *liveMenu) handleSearchKey(key menuKey) bool {
+	switch key.code {
+	case keyRune:
+		m.setQuery(m.query + string(key.r))
+	case keyBackspace:
+		if m.query == "" {
+			m.searching = false
+			return true
+		}
+		r := []rune(m.query)
+		m.setQuery(string(r[:len(r)-1]))
+	case keyEscape:
+		m.searching = false
+		m.setQuery("")
+	default:
+		return false
+	}
+	return true
+}
+
+// setQuery re-filters the list; the cursor jumps to the best match.
+func (m *liveMenu) setQuery(query string) {
+	m.query = query
+	m.followTop = true
+	m.refresh()
+}
+
+// toggleMark adds the highlighted node to the urltest group or removes it.
+func (m *liveMenu) toggleMark() {
+	if len(m.items) == 0 {
+		return
+	}
+	raw := m.items[m.cursor].raw
+	if m.marked[raw] {
+		delete(m.marked, raw)
+	} else {
+		m.marked[raw] = true
+	}
+	m.move(1)
+}
+
+// chosen is what Enter picks: the marked nodes in ranking order, including
+// those hidden by the search or the country filter, or else the highlighted
+// node.
+func (m *liveMenu) chosen() []proxyEntry {
+	if len(m.marked) > 0 {
+		items, _ := m.board.snapshot()
+		sortEntries(items, m.sortMode, m.withHTTP)
+		var group []proxyEntry
+		for _, entry := range items {
+			if m.marked[entry.raw] {
+				group = append(group, entry)
+			}
+		}
+		if len(group) > 0 {
+			return group
+		}
+	}
+	if len(m.items) == 0 {
+		return nil
+	}
+	return m.items[m.cursor : m.cursor+1]
+}
+
+// toggleFavorite flips the highlighted node and saves the state right away,
+// so the choice is kept even if the menu is cancelled afterwards.
+func (m *liveMenu) toggleFavorite() {
+	if len(m.items) == 0 {
+		return
+	}
+	entry := m.items[m.cursor]
+	favorite := m.state.toggleFavorite(entry)
+	m.board.update(func(entries []proxyEntry) {
+		for i := range entries {
+			if entries[i].key == entry.key {
+				entries[i].favorite = favorite
+			}
+		}
+	})
+	if err := m.state.save(); err != nil {
+		m.board.setStatus(fmt.Sprintf("Избранное не сохранено: %v", err))
+	}
+	m.followTop = false
+	m.cursorRaw = entry.raw
+	m.refresh()
+}
+
+// menuSortModes lists the orders the 's' key cycles through; modes without
+// data behind them in this run are left out.
+func (m *liveMenu) menuSortModes() []string {
+	modes := []string{sortByHealth}
+	if m.opts.speedTest {
+		modes = append(modes, sortBySpeed)
+	}
+	modes = append(modes, sortByRTT)
+	if m.withHTTP {
+		modes = append(modes, sortByHTTP)
+	}
+	modes = append(modes, sortByName)
+	if !m.opts.noHistory {
+		modes = append(modes, sortByReliability)
+	}
+	return modes
+}
+
+func (m *liveMenu) cycleSort() {
+	modes := m.menuSortModes()
+	next := modes[0]
+	for i, mode := range modes {
+		if mode == m.sortMode {
+			next = modes[(i+1)%len(modes)]
+			break
+		}
+	}
+	m.sortMode = next
+	m.refresh()
+}
+
+// cycleCountry steps the country filter through the countries present in the
+// list and back to showing everything.
+func (m *liveMenu) cycleCountry() {
+	items, _ := m.board.snapshot()
+	seen := map[string]bool{}
+	var countries []string
+	for _, entry := range items {
+		if country := entryCountry(entry); country != "" && !seen[country] {
+			seen[country] = true
+			countries = append(countries, country)
+		}
+	}
+	sort.Strings(countries)
+
+	next := ""
+	if len(countries) > 0 {
+		next = countries[0]
+	}
+	for i, country := range countries {
+		if country == m.country {
+			next = ""
+			if i+1 < len(countries) {
+				next = countries[i+1]
+			}
+			break
+		}
+	}
+	m.country = next
+	m.followTop = true
+	m.refresh()
+}
+
+// reloadSubscription fetches the subscription again and re-probes every node.
+// It runs as a pipeline job, so it also cancels any probes in flight.
+func (m *liveMenu) reloadSubscription() {
+	favorites := make(map[string]bool, len(m.state.Favorites))
+	for key := range m.state.Favorites {
+		favorites[key] = true
+	}
+	board, opts := m.board, m.opts
+	m.runner.run(func(ctx context.Context) {
+		board.setStatus("Обновление подписки...")
+		entries, err := fetchEntries(ctx, opts)
+		if err != nil {
+			board.logf("Подписка не обновлена: %v", err)
+			return
+		}
+		for i := range entries {
+			entries[i].favorite = favorites[entries[i].id]
+		}
+		board.replace(entries)
+		board.logf("Подписка обновлена: %d конфигов", len(entries))
+		probeEntries(ctx, board, opts)
+	})
+}
+
+func (m *liveMenu) move(delta int) {
+	if len(m.items) == 0 {
+		return
+	}
+	m.cursor += delta
+	if m.cursor < 0 {
+		m.cursor = 0
+	}
+	if m.cursor >= len(m.items) {
+		m.cursor = len(m.items) - 1
+	}
+	m.cursorRaw = m.items[m.cursor].raw
+	m.followTop = false
+}
+
+func (m *liveMenu) render() {
+	width, height := terminalSize()
+	header := []string{
+		"Enter:выбор Space:группа /:поиск f:избранное i:детали r/R:тест s:сорт c/g:страна u:подписка q:выход",
+		fmt.Sprintf("[сортировка: %s] %s", m.sortMode, m.status),
+	}
+	if m.country != "" || m.grouped {
+		var view []string
+		if m.country != "" {
+			view = append(view, "страна: "+m.country+" (c - следующая)")
+		}
+		if m.grouped {
+			view = append(view, "группировка по странам (g - выключить)")
+		}
+		header = append(header, strings.Join(view, " | "))
+	}
+	if exit := m.opts.chainExitEntry; exit != nil {
+		header = append(header, fmt.Sprintf("Цепочка: выбранный узел -> %s (HTTP/UDP/exit IP через цепочку)", exit.name))
+	}
+	if len(m.marked) > 0 {
+		header = append(header, fmt.Sprintf("В группе: %d (Enter - urltest группа из отмеченных, Space - снять отметку)", len(m.marked)))
+	}
+	if m.searching || m.query != "" {
+		search := fmt.Sprintf("Поиск: %s", m.query)
+		if m.searching {
+			search += "_ (Esc - сбросить)"
+		}
+		if len(m.items) == 0 {
+			search += " — нет совпадений"
+		}
+		header = append(header, search)
+	}
+
+	var details []detailLine
+	if m.details && len(m.items) > 0 {
+		details = entryDetails(m.items[m.cursor])
+	}
+
+	m.pageSize = height - len(header) - 1
+	if len(details) > 0 {
+		m.pageSize -= len(details) + 1
+	}
+	if m.pageSize < 3 {
+		m.pageSize = 3
+	}
+	if m.cursor < m.offset {
+		m.offset = m.cursor
+	}
+	if m.cursor >= m.offset+m.pageSize {
+		m.offset = m.cursor - m.pageSize + 1
+	}
+	if maxOffset := len(m.items) - m.pageSize; m.offset > maxOffset {
+		m.offset = maxOffset
+	}
+	if m.offset < 0 {
+		m.offset = 0
+	}
+
+	var b strings.Builder
+	b.WriteString("\033[H")
+	for _, line := range header {
+		b.WriteString("\033[K" + clipRunes(line, width-1) + "\r\n")
+	}
+
+	columns := entryColumns(m.items)
+	end := minInt(m.offset+m.pageSize, len(m.items))
+	for i := m.offset; i < end; i++ {
+		marker := " "
+		if i == m.cursor {
+			marker = "▸"
+		}
+		if m.marked[m.items[i].raw] {
+			marker += "+ "
+		} else {
+			marker += "  "
+		}
+		prefix := marker + menuRowPrefix(m.items[i], i, columns)
+		line := prefix + displayName(m.items[i])
+		row := clipRunes(line, width-1)
+		if match, ok := m.matches[m.items[i].raw]; ok {
+			offset := utf8.RuneCountInString(prefix) + utf8.RuneCountInString(displayName(m.items[i])) - utf8.RuneCountInString(m.items[i].name)
+			marks := match.nameMarks
+			if row != line {
+				// Keep the "..." of a clipped row unmarked.
+				marks = map[int]bool{}
+				for pos := range match.nameMarks {
+					if offset+pos < width-4 {
+						marks[pos] = true
+					}
+				}
+			}
+			row = highlightRunes(row, offset, marks)
+		}
+		if i == m.cursor {
+			row = "\033[1m" + row + "\033[0m"
+		}
+		b.WriteString("\033[K" + row + "\r\n")
+	}
+	if len(details) > 0 {
+		b.WriteString("\033[K" + strings.Repeat("─", width-1) + "\r\n")
+		for _, line := range details {
+			b.WriteString("\033[K" + clipRunes(fmt.Sprintf("%-13s %s", line.label+":", line.value), width-1) + "\r\n")
+		}
+	}
+	b.WriteString("\033[J")
+	_, _ = os.Stdout.WriteString(b.String())
+}
+
+func renderMenuRow(entry proxyEntry, index int, columns []entryColumn) string {
+	return menuRowPrefix(entry, index, columns) + displayName(entry)
+}
+
+func menuRowPrefix(entry proxyEntry, index int, columns []entryColumn) string {
+	return fmt.Sprintf("%2d | %s | ", index+1, renderColumns(entry, columns, " ", " | "))
+}
+
+func terminalSize() (int, int) {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 || height <= 0 {
+		return 100, 24
+	}
+	return width, height
+}
@@ -0,0 +1,68 @@
+package app
+
+import (
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestParseKeys(t *testing.T) {
+	keys := parseKeys([]byte("a\x1b[A\x1b[B\x1b[5~\r\x7f\x1bя"))
+	want := []menuKey{
+		{code: keyRune, r: 'a'},
+		{code: keyUp},
+		{code: keyDown},
+		{code: keyPageUp},
+		{code: keyEnter},
+		{code: keyBackspace},
+		{code: keyEscape},
+		{code: keyRune, r: 'я'},
+	}
+	if len(keys) != len(want) {
+		t.Fatalf("parseKeys = %v, want %v", keys, want)
+	}
+	for i := range want {
+		if keys[i] != want[i] {
+			t.Errorf("key %d = %v, want %v", i, keys[i], want[i])
+		}
+	}
+}
+
+// TestKeyReaderStops checks that a stopped reader leaves later input alone.
+func TestKeyReaderStops(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("pipes cannot be waited on like a console on Windows")
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	keys, stop := startKeyReader(r)
+	if _, err := w.Write([]byte("q")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case key := <-keys:
+		if key.r != 'q' {
+			t.Errorf("key = %v, want q", key)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("key press not delivered")
+	}
+
+	stop()
+	if _, err := w.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1)
+	if _, err := r.Read(buf); err != nil || buf[0] != 'x' {
+		t.Errorf("input after stop was consumed: %q, %v", buf, err)
+	}
+	if _, ok := <-keys; ok {
+		t.Error("key channel must be closed after stop")
+	}
+}
@@ -8,18 +8,32 @@ import (
 )
 
 const (
-	defaultMixedListen     = "127.0.0.1"
-	defaultMixedPort       = 2080
-	defaultTunName         = "sb-tun"
-	defaultTunAddress      = "172.19.0.1/30"
-	defaultTunMTU          = 1400
-	defaultTunStack        = "mixed"
-	defaultTunBootstrapDNS = "1.1.1.1"
-	defaultTunRemoteDNS    = "https://1.1.1.1/dns-query"
-	defaultTunDNSStrategy  = "prefer_ipv4"
-	defaultHealthURL       = "https://www.gstatic.com/generate_204"
-	defaultLogLevel        = "info"
-	maxSubscriptionBody    = 8 << 20
+	defaultMixedListen      = "127.0.0.1"
+	defaultMixedPort        = 2080
+	defaultTunName          = "sb-tun"
+	defaultTunAddress       = "172.19.0.1/30"
+	defaultTunAddress6      = "fdfe:dcba:9876::1/126"
+	defaultFakeIPRange4     = "198.18.0.0/15"
+	defaultFakeIPRange6     = "fc00::/18"
+	defaultTunMTU           = 1400
+	defaultTunStack         = "mixed"
+	defaultTunBootstrapDNS  = "1.1.1.1"
+	defaultTunRemoteDNS     = "https://1.1.1.1/dns-query"
+	defaultTunDNSStrategy   = "prefer_ipv4"
+	defaultHealthURL        = "https://www.gstatic.com/generate_204"
+	defaultSpeedURL         = "https://speed.cloudflare.com/__down?bytes=25000000"
+	defaultExitIPURL        = "https://ipinfo.io/json"
+	defaultUDPDNS           = "1.1.1.1:53"
+	defaultClashAPI         = "127.0.0.1:9090"
+	defaultURLTestInterval  = 3 * time.Minute
+	defaultURLTestTolerance = 50
+	defaultLogLevel         = "info"
+	ipFamilyAuto            = "auto"
+	ipFamilyPreferIPv4      = "prefer_ipv4"
+	ipFamilyPreferIPv6      = "prefer_ipv6"
+	ipFamilyIPv4Only        = "ipv4_only"
+	ipFamilyIPv6Only        = "ipv6_only"
+	maxSubscriptionBody     = 8 << 20
 )
 
 type options struct {
@@ -35,12 +49,36 @@ type options struct {
 	tunStack        string
 	tunBootstrapDNS string
 	tunRemoteDNS    string
+	tunLocalDNS     string
+	tunBypassLAN    bool
+	tunExclude      string
+	tunIPv6         bool
+	tunFakeIP       bool
+	fakeIPRange4    string
+	fakeIPRange6    string
+	fakeIPCache     string
+	tunPolicy       tunPolicy
+
+	tunDNSCache            bool
+	tunDNSIndependentCache bool
 
 	mixedListen string
 	mixedPort   int
+	ipFamily    string
+
+	countries string
+	geoIPPath string
+	geoIP     *geoIPDB
+
+	rulesPath        string
+	bypassProcess    string
+	proxyOnlyProcess string
+	routing          *routingRules
 
 	probeTimeout  time.Duration
 	probeWorkers  int
+	probeSamples  int
+	probeDeadline time.Duration
 	healthCheck   bool
 	skipRTT       bool
 	skipHTTP      bool
@@ -48,50 +86,170 @@ type options struct {
 	healthURL     string
 	healthTimeout time.Duration
 	healthWorkers int
+	healthSamples int
+
+	historyPath string
+	noHistory   bool
+
+	statePath  string
+	selectLast bool
+
+	exitIPCheck bool
+	exitIPURL   string
+
+	udpCheck bool
+	udpDNS   string
+
+	speedTest     bool
+	speedURL      string
+	speedTop      int
+	speedMaxBytes int64
+	speedTimeout  time.Duration
+	sortBy        string
 
 	selectedIndex int
-	dryRun        bool
-	printConfig   bool
-	keepConfig    bool
-	skipCheck     bool
+	selectName    string
+	selectID      string
+
+	autoSelect      bool
+	autoMaxRTT      time.Duration
+	autoRequireHTTP bool
+	autoRequireUDP  bool
+
+	group            string
+	groupTop         int
+	urltestURL       string
+	urltestInterval  time.Duration
+	urltestTolerance int
+
+	selector       bool
+	selectorFilter string
+	clashAPI       string
+	clashSecret    string
+
+	chainExit      string
+	chainURL       string
+	chainExitEntry *proxyEntry
+
+	dryRun      bool
+	printConfig bool
+	keepConfig  bool
+	skipCheck   bool
+
+	// explicit holds the flags given on the command line, for checks that
+	// must not fire on default values.
+	explicit map[string]bool
 }
 
 func parseFlags() options {
+	// flag.CommandLine exits on a parse error.
+	opts, _ := parseArgs(flag.CommandLine, os.Args[1:])
+	return opts
+}
+
+// parseArgs defines the flags on fs and parses args into options.
+func parseArgs(fs *flag.FlagSet, args []string) (options, error) {
 	defaultURL := strings.TrimSpace(os.Getenv("SUBBOX_URL"))
 
 	opts := options{}
-	flag.StringVar(&opts.subscriptionURL, "url", defaultURL, "URL подписки (обязательно, если не задан SUBBOX_URL)")
-	flag.StringVar(&opts.singBoxBinary, "bin", "sing-box", "путь к бинарнику sing-box")
-	flag.StringVar(&opts.configPath, "config", "", "куда сохранить сгенерированный конфиг")
-	flag.StringVar(&opts.logLevel, "log-level", defaultLogLevel, "уровень логов sing-box")
-
-	flag.BoolVar(&opts.useTun, "tun", false, "включить TUN режим (весь трафик через VPN)")
-	flag.StringVar(&opts.tunName, "tun-name", defaultTunName, "имя TUN интерфейса")
-	flag.StringVar(&opts.tunAddress, "tun-address", defaultTunAddress, "адрес TUN интерфейса (CSV)")
-	flag.IntVar(&opts.tunMTU, "tun-mtu", defaultTunMTU, "MTU для TUN интерфейса")
-	flag.StringVar(&opts.tunStack, "tun-stack", defaultTunStack, "TCP/IP стек TUN: system|mixed|gvisor")
-	flag.StringVar(&opts.tunBootstrapDNS, "tun-bootstrap-dns", defaultTunBootstrapDNS, "DNS для первичного резолва VPN endpoint")
-	flag.StringVar(&opts.tunRemoteDNS, "tun-remote-dns", defaultTunRemoteDNS, "DNS сервер для TUN режима (например DoH)")
-
-	flag.StringVar(&opts.mixedListen, "listen", defaultMixedListen, "адрес mixed inbound")
-	flag.IntVar(&opts.mixedPort, "port", defaultMixedPort, "порт mixed inbound")
-
-	flag.DurationVar(&opts.probeTimeout, "probe-timeout", 1500*time.Millisecond, "таймаут RTT теста")
-	flag.IntVar(&opts.probeWorkers, "probe-workers", 12, "количество параллельных RTT тестов")
-	flag.BoolVar(&opts.healthCheck, "health-check", true, "выполнять HTTP-проверку каждого конфига перед меню")
-	flag.BoolVar(&opts.skipRTT, "skip-rtt", false, "пропустить RTT тест перед меню")
-	flag.BoolVar(&opts.skipHTTP, "skip-http", false, "пропустить HTTP тест перед меню")
-	flag.BoolVar(&opts.skipTests, "skip-tests", false, "пропустить все тесты перед меню (RTT и HTTP)")
-	flag.StringVar(&opts.healthURL, "health-url", defaultHealthURL, "URL для HTTP-проверки через каждый конфиг")
-	flag.DurationVar(&opts.healthTimeout, "health-timeout", 8*time.Second, "таймаут HTTP-проверки одного конфига")
-	flag.IntVar(&opts.healthWorkers, "health-workers", 3, "количество параллельных HTTP-проверок")
-
-	flag.IntVar(&opts.selectedIndex, "select", 0, "номер конфига для неинтерактивного выбора")
-	flag.BoolVar(&opts.dryRun, "dry-run", false, "не запускать sing-box, только собрать конфиг")
-	flag.BoolVar(&opts.printConfig, "print-config", false, "печатать сгенерированный JSON")
-	flag.BoolVar(&opts.keepConfig, "keep-config", false, "не удалять временный конфиг после завершения")
-	flag.BoolVar(&opts.skipCheck, "skip-check", false, "не выполнять sing-box check перед запуском")
-	flag.Parse()
+	fs.StringVar(&opts.subscriptionURL, "url", defaultURL, "URL подписки (обязательно, если не задан SUBBOX_URL)")
+	fs.StringVar(&opts.singBoxBinary, "bin", "sing-box", "путь к бинарнику sing-box")
+	fs.StringVar(&opts.configPath, "config", "", "куда сохранить сгенерированный конфиг")
+	fs.StringVar(&opts.logLevel, "log-level", defaultLogLevel, "уровень логов sing-box")
+
+	fs.BoolVar(&opts.useTun, "tun", false, "включить TUN режим (весь трафик через VPN)")
+	fs.StringVar(&opts.tunName, "tun-name", defaultTunName, "имя TUN интерфейса")
+	fs.StringVar(&opts.tunAddress, "tun-address", defaultTunAddress, "адрес TUN интерфейса (CSV)")
+	fs.IntVar(&opts.tunMTU, "tun-mtu", defaultTunMTU, "MTU для TUN интерфейса")
+	fs.StringVar(&opts.tunStack, "tun-stack", defaultTunStack, "TCP/IP стек TUN: system|mixed|gvisor")
+	fs.StringVar(&opts.tunBootstrapDNS, "tun-bootstrap-dns", defaultTunBootstrapDNS, "DNS для первичного резолва VPN endpoint")
+	fs.StringVar(&opts.tunRemoteDNS, "tun-remote-dns", defaultTunRemoteDNS, "DNS сервер для TUN режима (например DoH)")
+	tunDefaults := defaultTunPolicy()
+	fs.BoolVar(&opts.tunIPv6, "tun-ipv6", false, "добавить IPv6 адрес TUN ("+defaultTunAddress6+") и пускать IPv6 в туннель")
+	fs.BoolVar(&opts.tunPolicy.strictRoute, "tun-strict-route", tunDefaults.strictRoute, "strict_route: не пускать трафик мимо TUN (по умолчанию на Linux)")
+	fs.BoolVar(&opts.tunPolicy.autoRedirect, "tun-auto-redirect", tunDefaults.autoRedirect, "auto_redirect через nftables (только Linux, по умолчанию включен)")
+	fs.BoolVar(&opts.tunPolicy.addMixedInbound, "tun-mixed-inbound", tunDefaults.addMixedInbound, "добавить mixed inbound (--listen/--port) в TUN режиме")
+	fs.BoolVar(&opts.tunPolicy.forceTCP, "tun-force-tcp", tunDefaults.forceTCP, "только TCP через узел (UDP приложений не работает)")
+	fs.BoolVar(&opts.tunPolicy.blockQUIC, "tun-block-quic", tunDefaults.blockQUIC, "блокировать QUIC (udp/443), чтобы приложения переходили на TCP")
+	fs.StringVar(&opts.tunPolicy.dnsStrategy, "tun-dns-strategy", "", "стратегия DNS в TUN: prefer_ipv4|prefer_ipv6|ipv4_only|ipv6_only (по умолчанию --ip-family или "+defaultTunDNSStrategy+")")
+	fs.BoolVar(&opts.tunFakeIP, "tun-fakeip", false, "FakeIP DNS: домены получают фиктивные IP без запроса к удаленному DNS")
+	fs.StringVar(&opts.fakeIPRange4, "fakeip-range", defaultFakeIPRange4, "IPv4 диапазон FakeIP")
+	fs.StringVar(&opts.fakeIPRange6, "fakeip-range6", defaultFakeIPRange6, "IPv6 диапазон FakeIP (с --tun-ipv6)")
+	fs.StringVar(&opts.fakeIPCache, "fakeip-cache", defaultFakeIPCachePath(), "файл, где sing-box хранит выданные FakeIP между перезапусками (пусто - не хранить)")
+	fs.StringVar(&opts.tunLocalDNS, "tun-local-dns", "local", "DNS для доменов, которые идут direct: local (системный), dhcp, IP или URL")
+	fs.BoolVar(&opts.tunDNSCache, "tun-dns-cache", true, "кэшировать ответы DNS в TUN режиме")
+	fs.BoolVar(&opts.tunDNSIndependentCache, "tun-dns-independent-cache", false, "отдельный кэш DNS для каждого сервера (local/remote)")
+	fs.BoolVar(&opts.tunBypassLAN, "tun-bypass-lan", true, "не пускать в TUN локальные сети (RFC1918, link-local, CGNAT, multicast)")
+	fs.StringVar(&opts.tunExclude, "tun-exclude", "", "дополнительные IP/подсети мимо TUN (CSV)")
+
+	fs.StringVar(&opts.mixedListen, "listen", defaultMixedListen, "адрес mixed inbound")
+	fs.IntVar(&opts.mixedPort, "port", defaultMixedPort, "порт mixed inbound")
+	fs.StringVar(&opts.countries, "country", "", "только конфиги из этих стран (ISO коды через запятую, например DE,NL)")
+	fs.StringVar(&opts.geoIPPath, "geoip-db", "", "CSV база first_ip,last_ip,country для определения страны по IP сервера")
+	fs.StringVar(&opts.rulesPath, "rules", "", "JSON файл с правилами маршрутизации (direct/proxy/block по доменам, IP и rule set)")
+	fs.StringVar(&opts.bypassProcess, "bypass-process", "", "приложения мимо VPN (CSV: имя процесса, путь, package:, user:, uid:)")
+	fs.StringVar(&opts.proxyOnlyProcess, "proxy-only-process", "", "через VPN только эти приложения, остальное напрямую (CSV, как --bypass-process)")
+	fs.StringVar(&opts.ipFamily, "ip-family", ipFamilyAuto, "семейство адресов узла: auto|prefer_ipv4|prefer_ipv6|ipv4_only|ipv6_only")
+
+	fs.DurationVar(&opts.probeTimeout, "probe-timeout", 1500*time.Millisecond, "таймаут RTT теста")
+	fs.IntVar(&opts.probeWorkers, "probe-workers", 12, "количество параллельных RTT тестов")
+	fs.IntVar(&opts.probeSamples, "probe-samples", 1, "количество RTT замеров на один конфиг")
+	fs.DurationVar(&opts.probeDeadline, "probe-deadline", 0, "общий лимит времени на все проверки (0 - без лимита)")
+	fs.BoolVar(&opts.healthCheck, "health-check", true, "выполнять HTTP-проверку каждого конфига перед меню")
+	fs.BoolVar(&opts.skipRTT, "skip-rtt", false, "пропустить RTT тест перед меню")
+	fs.BoolVar(&opts.skipHTTP, "skip-http", false, "пропустить HTTP тест перед меню")
+	fs.BoolVar(&opts.skipTests, "skip-tests", false, "пропустить все тесты перед меню (RTT и HTTP)")
+	fs.StringVar(&opts.healthURL, "health-url", defaultHealthURL, "URL для HTTP-проверки через каждый конфиг")
+	fs.DurationVar(&opts.healthTimeout, "health-timeout", 8*time.Second, "таймаут HTTP-проверки одного конфига")
+	fs.IntVar(&opts.healthWorkers, "health-workers", 3, "количество параллельных HTTP-проверок")
+	fs.IntVar(&opts.healthSamples, "health-samples", 1, "количество HTTP замеров на один конфиг")
+
+	fs.StringVar(&opts.historyPath, "history-file", defaultHistoryPath(), "файл истории проверок для оценки надежности узлов")
+	fs.BoolVar(&opts.noHistory, "no-history", false, "не читать и не сохранять историю проверок")
+
+	fs.BoolVar(&opts.exitIPCheck, "exit-ip", false, "определить exit IP и страну каждого конфига")
+	fs.StringVar(&opts.exitIPURL, "exit-ip-url", defaultExitIPURL, "URL сервиса \"what is my IP\" (текст или JSON)")
+
+	fs.BoolVar(&opts.udpCheck, "udp-check", false, "проверить UDP через каждый конфиг (DNS запрос)")
+	fs.StringVar(&opts.udpDNS, "udp-dns", defaultUDPDNS, "DNS сервер для UDP проверки (host[:port])")
+
+	fs.BoolVar(&opts.speedTest, "speed-test", false, "замерить скорость загрузки через лучшие конфиги")
+	fs.StringVar(&opts.speedURL, "speed-url", defaultSpeedURL, "URL для теста скорости (http/https)")
+	fs.IntVar(&opts.speedTop, "speed-top", 5, "сколько лучших конфигов проверять на скорость")
+	fs.Int64Var(&opts.speedMaxBytes, "speed-max-bytes", 10<<20, "максимум байт загрузки в тесте скорости")
+	fs.DurationVar(&opts.speedTimeout, "speed-timeout", 10*time.Second, "максимальная длительность теста скорости одного конфига")
+	fs.StringVar(&opts.sortBy, "sort", sortByHealth, "сортировка меню: health|speed|rtt|http|name|reliability")
+
+	fs.IntVar(&opts.selectedIndex, "select", 0, "номер конфига для неинтерактивного выбора")
+	fs.BoolVar(&opts.selectLast, "last", false, "подключиться к последнему выбранному конфигу без меню и проверок")
+	fs.StringVar(&opts.statePath, "state-file", defaultStatePath(), "файл с последним выбранным конфигом и избранным (пусто - не сохранять)")
+	fs.StringVar(&opts.selectName, "select-name", "", "выбрать лучший конфиг, имя которого содержит подстроку или совпадает с regexp")
+	fs.StringVar(&opts.selectID, "select-id", "", "выбрать конфиг по стабильному ID (колонка ID в меню)")
+	fs.BoolVar(&opts.autoSelect, "auto", false, "без меню: выбрать лучший конфиг по результатам проверок")
+	fs.DurationVar(&opts.autoMaxRTT, "max-rtt", 0, "для --auto: максимальный RTT (0 - без лимита)")
+	fs.BoolVar(&opts.autoRequireHTTP, "require-http", false, "для --auto: только конфиги с успешной HTTP-проверкой")
+	fs.BoolVar(&opts.autoRequireUDP, "require-udp", false, "для --auto: только конфиги с успешной UDP-проверкой")
+	fs.StringVar(&opts.group, "group", "", "без меню: urltest группа из лучших конфигов (top:N)")
+	fs.StringVar(&opts.urltestURL, "urltest-url", defaultHealthURL, "URL, по которому sing-box проверяет узлы urltest группы")
+	fs.DurationVar(&opts.urltestInterval, "urltest-interval", defaultURLTestInterval, "интервал проверки узлов urltest группы")
+	fs.IntVar(&opts.urltestTolerance, "urltest-tolerance", defaultURLTestTolerance, "разница задержки (мс), при которой urltest переключает узел")
+	fs.BoolVar(&opts.selector, "selector", false, "добавить все конфиги в selector для переключения через Clash API без перезапуска")
+	fs.StringVar(&opts.selectorFilter, "selector-filter", "", "только конфиги, имя которых совпадает с regexp или подстрокой, в selector")
+	fs.StringVar(&opts.clashAPI, "clash-api", "", "адрес Clash API (по умолчанию "+defaultClashAPI+" с --selector)")
+	fs.StringVar(&opts.clashSecret, "clash-secret", "", "секрет Clash API")
+	fs.StringVar(&opts.chainExit, "chain-exit", "", "цепочка: выходной конфиг (ID или имя), выбранный в меню узел становится входом")
+	fs.StringVar(&opts.chainURL, "chain-url", "", "подписка, из которой берется --chain-exit (по умолчанию основная)")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "не запускать sing-box, только собрать конфиг")
+	fs.BoolVar(&opts.printConfig, "print-config", false, "печатать сгенерированный JSON")
+	fs.BoolVar(&opts.keepConfig, "keep-config", false, "не удалять временный конфиг после завершения")
+	fs.BoolVar(&opts.skipCheck, "skip-check", false, "не выполнять sing-box check перед запуском")
+	if err := fs.Parse(args); err != nil {
+		return options{}, err
+	}
+	opts.explicit = map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		opts.explicit[f.Name] = true
+	})
 
 	if opts.skipTests {
 		opts.skipRTT = true
@@ -101,5 +259,5 @@ func parseFlags() options {
 		opts.healthCheck = false
 	}
 
-	return opts
+	return opts, nil
 }
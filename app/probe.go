@@ -6,82 +6,370 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
+// flakyPenalty is added to the ranking latency per 100% of failed samples.
+const flakyPenalty = time.Second
+
 type probeOutcome struct {
-	index   int
-	latency time.Duration
-	err     error
+	stats probeStats
+	v4    probeStats
+	v6    probeStats
+	err   error
 }
 
 type httpProbeOutcome struct {
-	index   int
-	status  int
-	latency time.Duration
-	err     error
+	status int
+	stats  probeStats
+	err    error
+}
+
+// probeStats summarises repeated samples of one probe against one node.
+type probeStats struct {
+	samples  int
+	failures int
+	min      time.Duration
+	median   time.Duration
+	p95      time.Duration
+	jitter   time.Duration
+}
+
+func newProbeStats(latencies []time.Duration, failures int) probeStats {
+	stats := probeStats{
+		samples:  len(latencies) + failures,
+		failures: failures,
+	}
+	if len(latencies) == 0 {
+		return stats
+	}
+
+	// Jitter is the mean difference between consecutive samples, so it is
+	// computed in collection order before sorting.
+	if len(latencies) > 1 {
+		var total time.Duration
+		for i := 1; i < len(latencies); i++ {
+			diff := latencies[i] - latencies[i-1]
+			if diff < 0 {
+				diff = -diff
+			}
+			total += diff
+		}
+		stats.jitter = total / time.Duration(len(latencies)-1)
+	}
+
+	sorted := append([]time.Duration(nil), latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	stats.min = sorted[0]
+	stats.median = percentileDuration(sorted, 50)
+	stats.p95 = percentileDuration(sorted, 95)
+	return stats
+}
+
+func percentileDuration(sorted []time.Duration, pct int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (pct*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
+
+func (s probeStats) lossRatio() float64 {
+	if s.samples == 0 {
+		return 0
+	}
+	return float64(s.failures) / float64(s.samples)
+}
+
+// penalize inflates latency of flaky nodes so that a stable node ranks above
+// one that answered fast only some of the time.
+func (s probeStats) penalize(latency time.Duration) time.Duration {
+	return latency + time.Duration(s.lossRatio()*float64(flakyPenalty))
 }
 
-func probeEntriesRTT(entries []proxyEntry, timeout time.Duration, workers int) {
-	if len(entries) == 0 {
+func probeEntriesRTT(ctx context.Context, board *probeBoard, opts options) {
+	entries, indexes := board.stage()
+	if len(indexes) == 0 {
 		return
 	}
-	if workers > len(entries) {
-		workers = len(entries)
+
+	progress := board.newProgress("RTT", len(indexes))
+	runProbePool(ctx, indexes, opts.probeWorkers,
+		func(idx int) probeOutcome {
+			return sampleEntryRTT(ctx, entries[idx], opts.probeTimeout, opts.probeSamples, opts.ipFamily)
+		},
+		func(idx int, res probeOutcome) {
+			if res.err != nil && ctx.Err() != nil {
+				return
+			}
+			board.update(func(entries []proxyEntry) {
+				entries[idx].tested = true
+				entries[idx].rttStats = res.stats
+				entries[idx].rtt4 = res.v4
+				entries[idx].rtt6 = res.v6
+				entries[idx].latency = res.stats.median
+				if res.err != nil {
+					entries[idx].probeErr = normalizeProbeError(res.err)
+					entries[idx].probeErrDetail = res.err.Error()
+				}
+			})
+			progress.record(res.err == nil, entries[idx].name, res.stats.median)
+		},
+	)
+	progress.finish()
+}
+
+// runProbePool runs probe for every index on a pool of workers and hands each
+// result to apply on the calling goroutine, so apply may write entries without
+// locking. Once ctx is cancelled no new jobs are scheduled, but results of the
+// jobs already running are still applied.
+func runProbePool[T any](ctx context.Context, indexes []int, workers int, probe func(idx int) T, apply func(idx int, result T)) {
+	if len(indexes) == 0 {
+		return
+	}
+	if workers > len(indexes) {
+		workers = len(indexes)
 	}
 	if workers < 1 {
 		workers = 1
 	}
 
+	type poolResult struct {
+		index int
+		value T
+	}
+
 	jobs := make(chan int)
-	results := make(chan probeOutcome, len(entries))
+	results := make(chan poolResult, len(indexes))
 
+	var wg sync.WaitGroup
 	for i := 0; i < workers; i++ {
+		wg.Add(1)
 		go func() {
+			defer wg.Done()
 			for idx := range jobs {
-				latency, err := probeEntryRTT(entries[idx], timeout)
-				results <- probeOutcome{index: idx, latency: latency, err: err}
+				results <- poolResult{index: idx, value: probe(idx)}
 			}
 		}()
 	}
 
-	for i := range entries {
-		jobs <- i
-	}
-	close(jobs)
-
-	for i := 0; i < len(entries); i++ {
-		res := <-results
-		entries[res.index].tested = true
-		entries[res.index].latency = res.latency
-		if res.err != nil {
-			entries[res.index].probeErr = normalizeProbeError(res.err)
+	go func() {
+		defer close(jobs)
+		for _, idx := range indexes {
+			if ctx.Err() != nil {
+				return
+			}
+			select {
+			case jobs <- idx:
+			case <-ctx.Done():
+				return
+			}
 		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	for res := range results {
+		apply(res.index, res.value)
 	}
 }
 
-func probeEntryRTT(entry proxyEntry, timeout time.Duration) (time.Duration, error) {
-	if entry.uri == nil {
-		return 0, errors.New("bad uri")
+// sampleEntryRTT dials the node several times over every address family it
+// resolves to. The overall stats follow the preferred family and carry an
+// error only when every sample failed.
+func sampleEntryRTT(ctx context.Context, entry proxyEntry, timeout time.Duration, samples int, family string) probeOutcome {
+	if samples < 1 {
+		samples = 1
 	}
-	host := entry.uri.Hostname()
-	if host == "" {
-		return 0, errors.New("no host")
+	if entry.uri == nil {
+		return probeOutcome{stats: newProbeStats(nil, samples), err: errors.New("bad uri")}
 	}
 	port := entry.uri.Port()
 	if port == "" {
 		port = "443"
 	}
+	v4, v6, err := resolveNodeAddrs(ctx, entry.uri.Hostname(), timeout)
+	if err != nil {
+		return probeOutcome{stats: newProbeStats(nil, samples), err: err}
+	}
+
+	var latencies, latencies4, latencies6 []time.Duration
+	var failures, failures4, failures6 int
+	var lastErr error
+	for i := 0; i < samples; i++ {
+		if i > 0 {
+			if err := sleepContext(ctx, 100*time.Millisecond); err != nil {
+				lastErr = err
+				break
+			}
+		}
+		sample := dialFamilies(ctx, v4, v6, port, timeout)
+		if sample.has4 {
+			if sample.err4 != nil {
+				failures4++
+			} else {
+				latencies4 = append(latencies4, sample.v4)
+			}
+		}
+		if sample.has6 {
+			if sample.err6 != nil {
+				failures6++
+			} else {
+				latencies6 = append(latencies6, sample.v6)
+			}
+		}
+		latency, err := sample.pick(family)
+		if err != nil {
+			failures++
+			lastErr = err
+			continue
+		}
+		latencies = append(latencies, latency)
+	}
 
-	address := net.JoinHostPort(host, port)
+	outcome := probeOutcome{
+		stats: newProbeStats(latencies, failures),
+		v4:    newProbeStats(latencies4, failures4),
+		v6:    newProbeStats(latencies6, failures6),
+	}
+	if len(latencies) == 0 {
+		outcome.err = lastErr
+	}
+	return outcome
+}
+
+// rttSample is one round of TCP connects, one per address family the node
+// resolves to.
+type rttSample struct {
+	v4, v6     time.Duration
+	err4, err6 error
+	has4, has6 bool
+}
+
+// pick returns the latency that counts for ranking under the chosen family
+// preference; auto takes whichever family connected faster.
+func (s rttSample) pick(family string) (time.Duration, error) {
+	type familyResult struct {
+		has     bool
+		latency time.Duration
+		err     error
+	}
+	r4 := familyResult{has: s.has4, latency: s.v4, err: s.err4}
+	r6 := familyResult{has: s.has6, latency: s.v6, err: s.err6}
+
+	order := []familyResult{r4, r6}
+	switch family {
+	case ipFamilyIPv4Only:
+		order = []familyResult{r4}
+	case ipFamilyIPv6Only:
+		order = []familyResult{r6}
+	case ipFamilyPreferIPv6:
+		order = []familyResult{r6, r4}
+	case ipFamilyAuto:
+		if r6.has && r6.err == nil && (!r4.has || r4.err != nil || r6.latency < r4.latency) {
+			order = []familyResult{r6, r4}
+		}
+	}
+
+	var firstErr error
+	for _, r := range order {
+		if !r.has {
+			continue
+		}
+		if r.err == nil {
+			return r.latency, nil
+		}
+		if firstErr == nil {
+			firstErr = r.err
+		}
+	}
+	if firstErr == nil {
+		firstErr = errors.New("нет адреса нужного семейства")
+	}
+	return 0, firstErr
+}
+
+func resolveNodeAddrs(ctx context.Context, host string, timeout time.Duration) (net.IP, net.IP, error) {
+	if host == "" {
+		return nil, nil, errors.New("no host")
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			return ip, nil, nil
+		}
+		return nil, ip, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var v4, v6 net.IP
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			if v4 == nil {
+				v4 = addr.IP
+			}
+		} else if v6 == nil {
+			v6 = addr.IP
+		}
+	}
+	if v4 == nil && v6 == nil {
+		return nil, nil, fmt.Errorf("нет адресов для %s", host)
+	}
+	return v4, v6, nil
+}
+
+func dialFamilies(ctx context.Context, v4, v6 net.IP, port string, timeout time.Duration) rttSample {
+	var sample rttSample
+	var wg sync.WaitGroup
+	if v4 != nil {
+		sample.has4 = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sample.v4, sample.err4 = dialTCP(ctx, v4, port, timeout)
+		}()
+	}
+	if v6 != nil {
+		sample.has6 = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sample.v6, sample.err6 = dialTCP(ctx, v6, port, timeout)
+		}()
+	}
+	wg.Wait()
+	return sample
+}
+
+func dialTCP(ctx context.Context, ip net.IP, port string, timeout time.Duration) (time.Duration, error) {
 	dialer := net.Dialer{Timeout: timeout}
 
 	start := time.Now()
-	conn, err := dialer.Dial("tcp", address)
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
 	if err != nil {
 		return 0, err
 	}
@@ -89,82 +377,148 @@ func probeEntryRTT(entry proxyEntry, timeout time.Duration) (time.Duration, erro
 	return time.Since(start), nil
 }
 
-func probeEntriesHTTP(entries []proxyEntry, opts options) {
-	if len(entries) == 0 {
+func probeEntriesHTTP(ctx context.Context, board *probeBoard, opts options) {
+	entries, indexes := board.stage()
+	if len(indexes) == 0 {
 		return
 	}
 
+	markSkipped := func(entries []proxyEntry) {
+		for _, idx := range indexes {
+			entries[idx].httpTested = true
+			entries[idx].httpErr = "skip"
+		}
+	}
 	if _, err := exec.LookPath(opts.singBoxBinary); err != nil {
-		markHTTPProbeSkipped(entries)
+		board.update(markSkipped)
 		return
 	}
 	curlPath, err := exec.LookPath("curl")
 	if err != nil {
-		markHTTPProbeSkipped(entries)
+		board.update(markSkipped)
 		return
 	}
 
-	workers := opts.healthWorkers
-	if workers > len(entries) {
-		workers = len(entries)
-	}
-	if workers < 1 {
-		workers = 1
-	}
-
-	jobs := make(chan int)
-	results := make(chan httpProbeOutcome, len(entries))
-
-	for i := 0; i < workers; i++ {
-		go func() {
-			for idx := range jobs {
-				if entries[idx].probeErr != "" {
-					results <- httpProbeOutcome{index: idx, err: errors.New("skip")}
-					continue
-				}
-				status, latency, err := probeEntryHTTP(entries[idx], opts, curlPath)
-				results <- httpProbeOutcome{index: idx, status: status, latency: latency, err: err}
+	progress := board.newProgress("HTTP", len(indexes))
+	runProbePool(ctx, indexes, opts.healthWorkers,
+		func(idx int) httpProbeOutcome {
+			if entries[idx].probeErr != "" {
+				return httpProbeOutcome{err: errors.New("skip")}
 			}
-		}()
+			status, stats, err := probeEntryHTTP(ctx, entries[idx], opts, curlPath)
+			return httpProbeOutcome{status: status, stats: stats, err: err}
+		},
+		func(idx int, res httpProbeOutcome) {
+			if res.err != nil && ctx.Err() != nil {
+				return
+			}
+			board.update(func(entries []proxyEntry) {
+				entries[idx].httpTested = true
+				entries[idx].httpStats = res.stats
+				entries[idx].httpLatency = res.stats.median
+				entries[idx].httpStatus = res.status
+				if res.err != nil {
+					entries[idx].httpErr = normalizeHTTPProbeError(res.err)
+					entries[idx].httpErrDetail = res.err.Error()
+					return
+				}
+				entries[idx].httpOK = true
+			})
+			progress.record(res.err == nil, entries[idx].name, res.stats.median)
+		},
+	)
+	progress.finish()
+}
+
+func probeEntryHTTP(ctx context.Context, entry proxyEntry, opts options, curlPath string) (int, probeStats, error) {
+	samples := opts.healthSamples
+	if samples < 1 {
+		samples = 1
 	}
+	proxy, err := startProbeProxy(ctx, entry, opts, time.Duration(samples)*opts.healthTimeout+4*time.Second, probeTrafficTCP)
+	if err != nil {
+		return 0, probeStats{}, err
+	}
+	defer proxy.stop()
+	proxyAddr := proxy.addr
 
-	for i := range entries {
-		jobs <- i
+	requestURL := strings.TrimSpace(opts.healthURL)
+	if requestURL == "" {
+		requestURL = defaultHealthURL
 	}
-	close(jobs)
 
-	for i := 0; i < len(entries); i++ {
-		res := <-results
-		entries[res.index].httpTested = true
-		entries[res.index].httpLatency = res.latency
-		entries[res.index].httpStatus = res.status
-		if res.err != nil {
-			entries[res.index].httpErr = normalizeHTTPProbeError(res.err)
+	latencies := make([]time.Duration, 0, samples)
+	failures := 0
+	var lastErr error
+	var lastStatus int
+	for sample := 0; sample < samples; sample++ {
+		status, latency, err := doProxyHTTPCheckWithCurl(ctx, curlPath, proxyAddr, requestURL, opts.healthTimeout)
+		if err != nil && samples == 1 && sleepContext(ctx, 200*time.Millisecond) == nil {
+			// A single sample gets one retry: the first request through a
+			// freshly started sing-box occasionally fails on its own.
+			status, latency, err = doProxyHTTPCheckWithCurl(ctx, curlPath, proxyAddr, requestURL, opts.healthTimeout)
+		}
+		if ctx.Err() != nil {
+			return 0, newProbeStats(latencies, failures), ctx.Err()
+		}
+		if err != nil {
+			failures++
+			lastErr = err
 			continue
 		}
-		entries[res.index].httpOK = true
+		latencies = append(latencies, latency)
+		lastStatus = status
 	}
-}
 
-func markHTTPProbeSkipped(entries []proxyEntry) {
-	for i := range entries {
-		entries[i].httpTested = true
-		entries[i].httpErr = "skip"
+	stats := newProbeStats(latencies, failures)
+	if len(latencies) == 0 {
+		return 0, stats, lastErr
 	}
+	return lastStatus, stats, nil
 }
 
-func probeEntryHTTP(entry proxyEntry, opts options, curlPath string) (int, time.Duration, error) {
+// probeProxy is a short-lived sing-box exposing a single node as a local
+// mixed proxy, used by checks that need real traffic through the node.
+// Its process is bound to lifetime only, not to the caller's context: on
+// cancellation callers return early and stop terminates it gracefully.
+// Except for UDP probes, the node is restricted to TCP in TUN mode just like
+// the generated config.
+type probeProxy struct {
+	addr    string
+	cmd     *exec.Cmd
+	waitCh  chan error
+	cancel  context.CancelFunc
+	cleanup func()
+}
+
+// probeTraffic is what a probe proxy is started for.
+type probeTraffic int
+
+const (
+	probeTrafficTCP probeTraffic = iota
+	probeTrafficUDP
+	// probeTrafficSpeed sends loopback targets direct, so that a local HTTP
+	// server can stand in for --speed-url when testing offline.
+	probeTrafficSpeed
+)
+
+func startProbeProxy(ctx context.Context, entry proxyEntry, opts options, lifetime time.Duration, traffic probeTraffic) (*probeProxy, error) {
 	proxyOutbound, err := buildVLESSOutbound(entry.uri)
 	if err != nil {
-		return 0, 0, err
+		return nil, err
 	}
-	if opts.useTun {
+	if opts.useTun && opts.tunPolicy.forceTCP && traffic != probeTrafficUDP {
 		proxyOutbound["network"] = "tcp"
 	}
+	applyIPFamily(proxyOutbound, opts.ipFamily, "local")
+	outbounds, err := chainProbeOutbounds(proxyOutbound, opts)
+	if err != nil {
+		return nil, err
+	}
 
 	port, err := reserveLocalPort()
 	if err != nil {
-		return 0, 0, err
+		return nil, err
 	}
 
 	config := map[string]any{
@@ -177,77 +531,101 @@ func probeEntryHTTP(entry proxyEntry, opts options, curlPath string) (int, time.
 				"listen_port": port,
 			},
 		},
-		"outbounds": []any{
-			proxyOutbound,
+		"outbounds": append(outbounds,
 			map[string]any{"type": "direct", "tag": "direct"},
 			map[string]any{"type": "block", "tag": "block"},
-		},
-		"route": map[string]any{
-			"auto_detect_interface": true,
-			"final":                 "proxy",
-		},
+		),
+		"route": probeProxyRoute(traffic),
+	}
+
+	if dns := localDNSConfig(opts.ipFamily); dns != nil {
+		config["dns"] = dns
 	}
 
 	configPath, cleanupConfig, err := writeConfig(config, "", false)
 	if err != nil {
-		return 0, 0, err
+		return nil, err
 	}
-	defer cleanupConfig()
 
-	totalTimeout := opts.healthTimeout + 4*time.Second
-	ctx, cancel := context.WithTimeout(context.Background(), totalTimeout)
-	defer cancel()
-
-	cmd := exec.CommandContext(ctx, opts.singBoxBinary, "run", "-c", configPath)
+	processCtx, cancel := context.WithTimeout(context.Background(), lifetime)
+	cmd := exec.CommandContext(processCtx, opts.singBoxBinary, "run", "-c", configPath)
 	cmd.Stdout = io.Discard
 	cmd.Stderr = io.Discard
 	if err := cmd.Start(); err != nil {
-		return 0, 0, err
+		cancel()
+		cleanupConfig()
+		return nil, err
 	}
 
-	waitCh := make(chan error, 1)
+	proxy := &probeProxy{
+		addr:    net.JoinHostPort("127.0.0.1", strconv.Itoa(port)),
+		cmd:     cmd,
+		waitCh:  make(chan error, 1),
+		cancel:  cancel,
+		cleanup: cleanupConfig,
+	}
 	go func() {
-		waitCh <- cmd.Wait()
+		proxy.waitCh <- cmd.Wait()
 	}()
-	defer stopProbeProcess(cmd, waitCh)
 
-	proxyAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
 	startTimeout := minDuration(3*time.Second, opts.healthTimeout)
 	if startTimeout < 500*time.Millisecond {
 		startTimeout = 500 * time.Millisecond
 	}
-	if err := waitForProxyReady(proxyAddr, waitCh, startTimeout); err != nil {
-		return 0, 0, err
+	if err := waitForProxyReady(ctx, proxy.addr, proxy.waitCh, startTimeout); err != nil {
+		proxy.stop()
+		return nil, err
 	}
+	return proxy, nil
+}
 
-	requestURL := strings.TrimSpace(opts.healthURL)
-	if requestURL == "" {
-		requestURL = defaultHealthURL
+// probeProxyRoute sends everything through the node, except loopback
+// targets of speed tests.
+func probeProxyRoute(traffic probeTraffic) map[string]any {
+	route := map[string]any{
+		"auto_detect_interface": true,
+		"final":                 "proxy",
 	}
-
-	var lastErr error
-	var lastStatus int
-	var lastLatency time.Duration
-	for attempt := 0; attempt < 2; attempt++ {
-		status, latency, err := doProxyHTTPCheckWithCurl(curlPath, proxyAddr, requestURL, opts.healthTimeout)
-		lastErr = err
-		lastStatus = status
-		lastLatency = latency
-		if err == nil {
-			return status, latency, nil
-		}
-		if attempt == 0 {
-			time.Sleep(200 * time.Millisecond)
+	if traffic == probeTrafficSpeed {
+		route["rules"] = []any{
+			map[string]any{
+				"ip_cidr":  []string{"127.0.0.0/8", "::1/128"},
+				"domain":   []string{"localhost"},
+				"outbound": "direct",
+			},
 		}
 	}
+	return route
+}
 
-	if lastErr != nil {
-		return 0, lastLatency, lastErr
+func (p *probeProxy) stop() {
+	stopProbeProcess(p.cmd, p.waitCh)
+	p.cancel()
+	p.cleanup()
+}
+
+func newProxyHTTPClient(proxyAddr string) *http.Client {
+	proxyURL := &url.URL{Scheme: "http", Host: proxyAddr}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:             http.ProxyURL(proxyURL),
+			DisableKeepAlives: true,
+		},
 	}
-	return lastStatus, lastLatency, nil
 }
 
-func doProxyHTTPCheckWithCurl(curlPath, proxyAddr, requestURL string, timeout time.Duration) (int, time.Duration, error) {
+// newDirectHTTPClient ignores HTTP(S)_PROXY: the leak check compares exit
+// IPs with the address this machine itself goes out from.
+func newDirectHTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:             nil,
+			DisableKeepAlives: true,
+		},
+	}
+}
+
+func doProxyHTTPCheckWithCurl(ctx context.Context, curlPath, proxyAddr, requestURL string, timeout time.Duration) (int, time.Duration, error) {
 	maxTimeSec := fmt.Sprintf("%.1f", timeout.Seconds())
 	connectTimeoutSec := fmt.Sprintf("%.1f", minDuration(3*time.Second, timeout).Seconds())
 	args := []string{
@@ -255,7 +633,6 @@ func doProxyHTTPCheckWithCurl(curlPath, proxyAddr, requestURL string, timeout ti
 		"--show-error",
 		"--output", "/dev/null",
 		"--write-out", "%{http_code}",
-		"--ipv4",
 		"--connect-timeout", connectTimeoutSec,
 		"--max-time", maxTimeSec,
 		"--proxy", "http://" + proxyAddr,
@@ -264,9 +641,12 @@ func doProxyHTTPCheckWithCurl(curlPath, proxyAddr, requestURL string, timeout ti
 	}
 
 	start := time.Now()
-	out, err := exec.Command(curlPath, args...).CombinedOutput()
+	out, err := exec.CommandContext(ctx, curlPath, args...).CombinedOutput()
 	latency := time.Since(start)
 	if err != nil {
+		if text := strings.TrimSpace(string(out)); text != "" {
+			return 0, latency, fmt.Errorf("%w: %s", err, text)
+		}
 		return 0, latency, err
 	}
 
@@ -295,10 +675,12 @@ func reserveLocalPort() (int, error) {
 	return addr.Port, nil
 }
 
-func waitForProxyReady(address string, waitCh <-chan error, timeout time.Duration) error {
+func waitForProxyReady(ctx context.Context, address string, waitCh <-chan error, timeout time.Duration) error {
 	deadline := time.Now().Add(timeout)
 	for time.Now().Before(deadline) {
 		select {
+		case <-ctx.Done():
+			return ctx.Err()
 		case err := <-waitCh:
 			if err == nil {
 				return errors.New("sing-box завершился до начала проверки")
@@ -336,6 +718,32 @@ func stopProbeProcess(cmd *exec.Cmd, waitCh <-chan error) {
 	}
 }
 
+// newProbeContext stops the probe pipeline on Ctrl+C/SIGTERM or once the
+// global probe deadline passes. The returned stop also restores the default
+// signal handling, so it must be called before the menu is shown.
+func newProbeContext(parent context.Context, deadline time.Duration) (context.Context, context.CancelFunc) {
+	ctx, stopSignals := signal.NotifyContext(parent, os.Interrupt, syscall.SIGTERM)
+	if deadline <= 0 {
+		return ctx, stopSignals
+	}
+	ctx, cancel := context.WithTimeout(ctx, deadline)
+	return ctx, func() {
+		cancel()
+		stopSignals()
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
 func minDuration(a, b time.Duration) time.Duration {
 	if a < b {
 		return a
@@ -0,0 +1,93 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func ms(values ...int) []time.Duration {
+	durations := make([]time.Duration, len(values))
+	for i, v := range values {
+		durations[i] = time.Duration(v) * time.Millisecond
+	}
+	return durations
+}
+
+func TestNewProbeStats(t *testing.T) {
+	tests := []struct {
+		name      string
+		latencies []time.Duration
+		failures  int
+		want      probeStats
+	}{
+		{"no samples", nil, 0, probeStats{}},
+		{"only failures", nil, 3, probeStats{samples: 3, failures: 3}},
+		{"one sample", ms(40), 0, probeStats{samples: 1, min: 40 * time.Millisecond, median: 40 * time.Millisecond, p95: 40 * time.Millisecond}},
+		{
+			// Jitter follows collection order: |10-30| and |30-20|.
+			"unsorted", ms(30, 10, 20), 1,
+			probeStats{samples: 4, failures: 1, min: 10 * time.Millisecond, median: 20 * time.Millisecond, p95: 30 * time.Millisecond, jitter: 15 * time.Millisecond},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := append([]time.Duration(nil), tt.latencies...)
+			if got := newProbeStats(tt.latencies, tt.failures); got != tt.want {
+				t.Errorf("newProbeStats() = %+v, want %+v", got, tt.want)
+			}
+			for i := range input {
+				if input[i] != tt.latencies[i] {
+					t.Fatalf("newProbeStats sorted its input: %v", tt.latencies)
+				}
+			}
+		})
+	}
+}
+
+func TestPercentileDuration(t *testing.T) {
+	sorted := ms(10, 20, 30, 40, 50, 60, 70, 80, 90, 100)
+	tests := []struct {
+		sorted []time.Duration
+		pct    int
+		want   time.Duration
+	}{
+		{nil, 50, 0},
+		{ms(7), 95, 7 * time.Millisecond},
+		{sorted, 0, 10 * time.Millisecond},
+		{sorted, 50, 50 * time.Millisecond},
+		{sorted, 51, 60 * time.Millisecond},
+		{sorted, 95, 100 * time.Millisecond},
+		{sorted, 100, 100 * time.Millisecond},
+		{ms(10, 20), 50, 10 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := percentileDuration(tt.sorted, tt.pct); got != tt.want {
+			t.Errorf("percentileDuration(%v, %d) = %s, want %s", tt.sorted, tt.pct, got, tt.want)
+		}
+	}
+}
+
+func TestPenalize(t *testing.T) {
+	tests := []struct {
+		stats   probeStats
+		latency time.Duration
+		want    time.Duration
+	}{
+		{probeStats{}, 80 * time.Millisecond, 80 * time.Millisecond},
+		{probeStats{samples: 5}, 80 * time.Millisecond, 80 * time.Millisecond},
+		{probeStats{samples: 4, failures: 1}, 80 * time.Millisecond, 80*time.Millisecond + flakyPenalty/4},
+		{probeStats{samples: 2, failures: 2}, 0, flakyPenalty},
+	}
+	for _, tt := range tests {
+		if got := tt.stats.penalize(tt.latency); got != tt.want {
+			t.Errorf("%+v.penalize(%s) = %s, want %s", tt.stats, tt.latency, got, tt.want)
+		}
+	}
+
+	// A stable node must rank above a faster one that loses samples.
+	stable := probeStats{samples: 4}.penalize(150 * time.Millisecond)
+	flaky := probeStats{samples: 4, failures: 1}.penalize(50 * time.Millisecond)
+	if stable >= flaky {
+		t.Errorf("stable %s ranks below flaky %s", stable, flaky)
+	}
+}
@@ -0,0 +1,121 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const (
+	progressRedrawInterval = 100 * time.Millisecond
+	progressPlainInterval  = 5 * time.Second
+)
+
+// probeProgress reports the state of one probe stage. On a terminal it keeps
+// redrawing a single status line; otherwise it prints a plain line every few
+// seconds so logs stay readable.
+type probeProgress struct {
+	label string
+	total int
+	done  int
+	ok    int
+	fail  int
+
+	bestName    string
+	bestLatency time.Duration
+
+	// live replaces terminal output while the live menu owns the screen.
+	live func(status string)
+
+	out       io.Writer
+	tty       bool
+	width     int
+	start     time.Time
+	lastPrint time.Time
+}
+
+func newProbeProgress(label string, total int) *probeProgress {
+	p := &probeProgress{
+		label: label,
+		total: total,
+		out:   os.Stdout,
+		width: 100,
+		start: time.Now(),
+	}
+	fd := int(os.Stdout.Fd())
+	if term.IsTerminal(fd) {
+		p.tty = true
+		if width, _, err := term.GetSize(fd); err == nil && width > 0 {
+			p.width = width
+		}
+	}
+	return p
+}
+
+func (p *probeProgress) record(ok bool, name string, latency time.Duration) {
+	p.done++
+	if !ok {
+		p.fail++
+	} else {
+		p.ok++
+		if latency > 0 && (p.bestName == "" || latency < p.bestLatency) {
+			p.bestName = name
+			p.bestLatency = latency
+		}
+	}
+
+	interval := progressPlainInterval
+	if p.tty {
+		interval = progressRedrawInterval
+	}
+	if p.live == nil && p.done < p.total && time.Since(p.lastPrint) < interval {
+		return
+	}
+	p.print()
+}
+
+func (p *probeProgress) finish() {
+	if p.total == 0 {
+		return
+	}
+	if p.lastPrint.IsZero() || p.done < p.total {
+		p.print()
+	}
+	if p.tty && p.live == nil {
+		fmt.Fprintln(p.out)
+	}
+}
+
+func (p *probeProgress) print() {
+	p.lastPrint = time.Now()
+	line := p.status()
+	if p.live != nil {
+		p.live(line)
+		return
+	}
+	if p.tty {
+		fmt.Fprintf(p.out, "\r\033[K%s", clipRunes(line, p.width-1))
+		return
+	}
+	fmt.Fprintln(p.out, line)
+}
+
+func (p *probeProgress) status() string {
+	line := fmt.Sprintf("%s: %d/%d | ok %d | fail %d", p.label, p.done, p.total, p.ok, p.fail)
+	if p.done > 0 && p.done < p.total {
+		elapsed := time.Since(p.start)
+		eta := elapsed / time.Duration(p.done) * time.Duration(p.total-p.done)
+		line += fmt.Sprintf(" | ETA %s", eta.Round(time.Second))
+	}
+	if p.bestName != "" {
+		ms := p.bestLatency.Milliseconds()
+		if ms < 1 {
+			ms = 1
+		}
+		line += fmt.Sprintf(" | лучший: %s (%dms)", p.bestName, ms)
+	}
+	return line
+}
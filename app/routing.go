@@ -0,0 +1,367 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// routingRules is the --rules file: user route rules compiled into
+// route.rules and the rule sets they reference. Rules are matched in order
+// before route.final, so the first matching rule wins.
+type routingRules struct {
+	Rules    []routingRule    `json:"rules"`
+	RuleSets []routingRuleSet `json:"rule_sets"`
+	// Final is where unmatched traffic goes: "proxy" (default) or "direct"
+	// to send only the matched applications through the VPN.
+	Final string `json:"final,omitempty"`
+	// DNS picks the TUN resolver for domain lists regardless of routing,
+	// e.g. corporate names that only the local resolver knows.
+	DNS []routingDNSRule `json:"dns,omitempty"`
+}
+
+type routingDNSRule struct {
+	Server        string   `json:"server"`
+	Domain        []string `json:"domain,omitempty"`
+	DomainSuffix  []string `json:"domain_suffix,omitempty"`
+	DomainKeyword []string `json:"domain_keyword,omitempty"`
+	RuleSet       []string `json:"rule_set,omitempty"`
+}
+
+type routingRule struct {
+	Outbound      string   `json:"outbound"`
+	Domain        []string `json:"domain,omitempty"`
+	DomainSuffix  []string `json:"domain_suffix,omitempty"`
+	DomainKeyword []string `json:"domain_keyword,omitempty"`
+	IPCIDR        []string `json:"ip_cidr,omitempty"`
+	RuleSet       []string `json:"rule_set,omitempty"`
+	ProcessName   []string `json:"process_name,omitempty"`
+	ProcessPath   []string `json:"process_path,omitempty"`
+	PackageName   []string `json:"package_name,omitempty"`
+	User          []string `json:"user,omitempty"`
+	UserID        []int    `json:"user_id,omitempty"`
+}
+
+// routingRuleSet is a sing-box rule set, either a local file or a URL that
+// sing-box downloads itself. Files ending in .json are source rule sets,
+// anything else is compiled (.srs).
+type routingRuleSet struct {
+	Tag            string `json:"tag"`
+	Path           string `json:"path,omitempty"`
+	URL            string `json:"url,omitempty"`
+	DownloadDetour string `json:"download_detour,omitempty"`
+	UpdateInterval string `json:"update_interval,omitempty"`
+}
+
+const (
+	ruleOutboundDirect = "direct"
+	ruleOutboundProxy  = "proxy"
+	ruleOutboundBlock  = "block"
+)
+
+func loadRoutingRules(path string) (*routingRules, error) {
+	if path == "" {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("чтение правил: %w", err)
+	}
+	rules := &routingRules{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(rules); err != nil {
+		return nil, fmt.Errorf("разбор правил %s: %w", path, err)
+	}
+	if err := rules.validate(); err != nil {
+		return nil, fmt.Errorf("правила %s: %w", path, err)
+	}
+	return rules, nil
+}
+
+func (r *routingRules) validate() error {
+	tags := map[string]bool{}
+	for i, set := range r.RuleSets {
+		set.Tag = strings.TrimSpace(set.Tag)
+		if set.Tag == "" {
+			return fmt.Errorf("rule_sets[%d]: пустой tag", i)
+		}
+		if tags[set.Tag] {
+			return fmt.Errorf("rule_sets[%d]: повторный tag %q", i, set.Tag)
+		}
+		tags[set.Tag] = true
+		if (set.Path == "") == (set.URL == "") {
+			return fmt.Errorf("rule set %q: нужен ровно один из path и url", set.Tag)
+		}
+		if set.Path != "" {
+			if _, err := os.Stat(set.Path); err != nil {
+				return fmt.Errorf("rule set %q: %w", set.Tag, err)
+			}
+		}
+		if set.URL != "" {
+			parsed, err := parseURL(set.URL)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return fmt.Errorf("rule set %q: неверный url %q", set.Tag, set.URL)
+			}
+		}
+		switch set.DownloadDetour {
+		case "", ruleOutboundDirect, ruleOutboundProxy:
+		default:
+			return fmt.Errorf("rule set %q: download_detour может быть direct или proxy", set.Tag)
+		}
+		r.RuleSets[i] = set
+	}
+
+	for i, rule := range r.Rules {
+		rule.Outbound = strings.ToLower(strings.TrimSpace(rule.Outbound))
+		switch rule.Outbound {
+		case ruleOutboundDirect, ruleOutboundProxy, ruleOutboundBlock:
+		default:
+			return fmt.Errorf("rules[%d]: outbound должен быть direct, proxy или block, получено %q", i, rule.Outbound)
+		}
+		if !rule.hasMatchers() {
+			return fmt.Errorf("rules[%d]: нет ни одного условия", i)
+		}
+		for j, cidr := range rule.IPCIDR {
+			normalized, err := normalizeCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("rules[%d]: %w", i, err)
+			}
+			rule.IPCIDR[j] = normalized
+		}
+		for _, tag := range rule.RuleSet {
+			if !tags[tag] {
+				return fmt.Errorf("rules[%d]: rule set %q не описан в rule_sets", i, tag)
+			}
+		}
+		r.Rules[i] = rule
+	}
+	r.Final = strings.ToLower(strings.TrimSpace(r.Final))
+	switch r.Final {
+	case "", ruleOutboundProxy, ruleOutboundDirect:
+	default:
+		return fmt.Errorf("final должен быть proxy или direct, получено %q", r.Final)
+	}
+	for i, rule := range r.DNS {
+		rule.Server = strings.ToLower(strings.TrimSpace(rule.Server))
+		if rule.Server != "local" && rule.Server != "remote" {
+			return fmt.Errorf("dns[%d]: server должен быть local или remote, получено %q", i, rule.Server)
+		}
+		if len(rule.Domain) == 0 && len(rule.DomainSuffix) == 0 && len(rule.DomainKeyword) == 0 && len(rule.RuleSet) == 0 {
+			return fmt.Errorf("dns[%d]: нет ни одного условия", i)
+		}
+		for _, tag := range rule.RuleSet {
+			if !tags[tag] {
+				return fmt.Errorf("dns[%d]: rule set %q не описан в rule_sets", i, tag)
+			}
+		}
+		r.DNS[i] = rule
+	}
+	if len(r.Rules) == 0 && len(r.DNS) == 0 {
+		return errors.New("нет ни одного правила")
+	}
+	return nil
+}
+
+// final is the route.final outbound.
+func (r *routingRules) final() string {
+	if r == nil || r.Final == "" {
+		return ruleOutboundProxy
+	}
+	return r.Final
+}
+
+// appRoutingRules turns --bypass-process/--proxy-only-process values into
+// rules. A value is a process name unless it is a path or carries a prefix:
+// "package:" (Android), "user:" or "uid:" (Linux). sing-box ANDs different
+// matcher kinds within a rule, so every kind gets a rule of its own.
+func appRoutingRules(values []string, outbound string) ([]routingRule, error) {
+	var rule routingRule
+	for _, value := range values {
+		kind, name, _ := strings.Cut(value, ":")
+		switch kind {
+		case "package":
+			rule.PackageName = append(rule.PackageName, name)
+		case "user":
+			rule.User = append(rule.User, name)
+		case "uid":
+			uid, err := strconv.Atoi(name)
+			if err != nil || uid < 0 {
+				return nil, fmt.Errorf("неверный uid: %q", name)
+			}
+			rule.UserID = append(rule.UserID, uid)
+		default:
+			switch {
+			case strings.ContainsAny(value, `/\`):
+				rule.ProcessPath = append(rule.ProcessPath, value)
+			case strings.Contains(value, ":"):
+				return nil, fmt.Errorf("неизвестный тип %q в %q (ожидается package:, user: или uid:)", kind, value)
+			default:
+				rule.ProcessName = append(rule.ProcessName, value)
+			}
+		}
+	}
+
+	var rules []routingRule
+	for _, split := range []routingRule{
+		{ProcessName: rule.ProcessName},
+		{ProcessPath: rule.ProcessPath},
+		{PackageName: rule.PackageName},
+		{User: rule.User},
+		{UserID: rule.UserID},
+	} {
+		if split.hasMatchers() {
+			split.Outbound = outbound
+			rules = append(rules, split)
+		}
+	}
+	return rules, nil
+}
+
+func (rule routingRule) hasMatchers() bool {
+	return len(rule.Domain) > 0 || len(rule.DomainSuffix) > 0 || len(rule.DomainKeyword) > 0 ||
+		len(rule.IPCIDR) > 0 || len(rule.RuleSet) > 0 ||
+		len(rule.ProcessName) > 0 || len(rule.ProcessPath) > 0 || len(rule.PackageName) > 0 ||
+		len(rule.User) > 0 || len(rule.UserID) > 0
+}
+
+// normalizeCIDR accepts a bare address as a single-host prefix.
+func normalizeCIDR(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if ip := net.ParseIP(raw); ip != nil {
+		if ip.To4() != nil {
+			return raw + "/32", nil
+		}
+		return raw + "/128", nil
+	}
+	if _, _, err := net.ParseCIDR(raw); err != nil {
+		return "", fmt.Errorf("неверный ip_cidr: %q", raw)
+	}
+	return raw, nil
+}
+
+// routeRules compiles the user rules. Block rules become reject actions,
+// the rest route to the named outbound.
+func (r *routingRules) routeRules() []any {
+	if r == nil {
+		return nil
+	}
+	compiled := make([]any, 0, len(r.Rules))
+	for _, rule := range r.Rules {
+		out := map[string]any{}
+		for key, values := range map[string][]string{
+			"domain":         rule.Domain,
+			"domain_suffix":  rule.DomainSuffix,
+			"domain_keyword": rule.DomainKeyword,
+			"ip_cidr":        rule.IPCIDR,
+			"rule_set":       rule.RuleSet,
+			"process_name":   rule.ProcessName,
+			"process_path":   rule.ProcessPath,
+			"package_name":   rule.PackageName,
+			"user":           rule.User,
+		} {
+			if len(values) > 0 {
+				out[key] = values
+			}
+		}
+		if len(rule.UserID) > 0 {
+			out["user_id"] = rule.UserID
+		}
+		if rule.Outbound == ruleOutboundBlock {
+			out["action"] = "reject"
+		} else {
+			out["outbound"] = rule.Outbound
+		}
+		compiled = append(compiled, out)
+	}
+	return compiled
+}
+
+// dnsRules sends DNS queries for the domains of rules routed to outbound to
+// the given DNS server. IP and application matchers say nothing about the
+// queried name and are left out.
+func (r *routingRules) dnsRules(outbound, server string) []any {
+	if r == nil {
+		return nil
+	}
+	var compiled []any
+	for _, rule := range r.Rules {
+		if rule.Outbound != outbound {
+			continue
+		}
+		out := map[string]any{}
+		for key, values := range map[string][]string{
+			"domain":         rule.Domain,
+			"domain_suffix":  rule.DomainSuffix,
+			"domain_keyword": rule.DomainKeyword,
+			"rule_set":       rule.RuleSet,
+		} {
+			if len(values) > 0 {
+				out[key] = values
+			}
+		}
+		if len(out) == 0 {
+			continue
+		}
+		out["server"] = server
+		compiled = append(compiled, out)
+	}
+	return compiled
+}
+
+// userDNSRules compiles the "dns" section of the rules file.
+func (r *routingRules) userDNSRules() []any {
+	if r == nil {
+		return nil
+	}
+	compiled := make([]any, 0, len(r.DNS))
+	for _, rule := range r.DNS {
+		out := map[string]any{"server": rule.Server}
+		for key, values := range map[string][]string{
+			"domain":         rule.Domain,
+			"domain_suffix":  rule.DomainSuffix,
+			"domain_keyword": rule.DomainKeyword,
+			"rule_set":       rule.RuleSet,
+		} {
+			if len(values) > 0 {
+				out[key] = values
+			}
+		}
+		compiled = append(compiled, out)
+	}
+	return compiled
+}
+
+func (r *routingRules) ruleSets() []any {
+	if r == nil {
+		return nil
+	}
+	sets := make([]any, 0, len(r.RuleSets))
+	for _, set := range r.RuleSets {
+		source := set.Path
+		out := map[string]any{"tag": set.Tag}
+		if set.Path != "" {
+			out["type"] = "local"
+			out["path"] = set.Path
+		} else {
+			source = set.URL
+			out["type"] = "remote"
+			out["url"] = set.URL
+			out["download_detour"] = firstNonEmpty(set.DownloadDetour, ruleOutboundDirect)
+			if set.UpdateInterval != "" {
+				out["update_interval"] = set.UpdateInterval
+			}
+		}
+		out["format"] = "binary"
+		if strings.HasSuffix(strings.ToLower(strings.SplitN(source, "?", 2)[0]), ".json") {
+			out["format"] = "source"
+		}
+		sets = append(sets, out)
+	}
+	return sets
+}
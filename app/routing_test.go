@@ -0,0 +1,206 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadRoutingRulesValidate(t *testing.T) {
+	dir := t.TempDir()
+	setPath := filepath.Join(dir, "ru.srs")
+	if err := os.WriteFile(setPath, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr string
+	}{
+		{"valid", `{"rules":[{"outbound":"Direct","domain_suffix":["ru"],"ip_cidr":["10.0.0.1"]}],"final":"DIRECT"}`, ""},
+		{"rule set path", `{"rules":[{"outbound":"block","rule_set":["ru"]}],"rule_sets":[{"tag":"ru","path":"` + setPath + `"}]}`, ""},
+		{"dns only", `{"dns":[{"server":"remote","domain":["a.ru"]}]}`, ""},
+		{"unknown field", `{"rules":[{"outbound":"direct","domains":["a.ru"]}]}`, "unknown field"},
+		{"empty", `{}`, "нет ни одного правила"},
+		{"bad outbound", `{"rules":[{"outbound":"vpn","domain":["a.ru"]}]}`, "outbound должен быть"},
+		{"no matchers", `{"rules":[{"outbound":"direct"}]}`, "нет ни одного условия"},
+		{"bad cidr", `{"rules":[{"outbound":"direct","ip_cidr":["10.0.0.0/33"]}]}`, "неверный ip_cidr"},
+		{"undefined rule set", `{"rules":[{"outbound":"direct","rule_set":["ru"]}]}`, "не описан в rule_sets"},
+		{"empty tag", `{"rules":[{"outbound":"direct","domain":["a.ru"]}],"rule_sets":[{"url":"https://example.com/ru.srs"}]}`, "пустой tag"},
+		{"duplicate tag", `{"rules":[{"outbound":"direct","domain":["a.ru"]}],"rule_sets":[{"tag":"ru","url":"https://example.com/a.srs"},{"tag":"ru","url":"https://example.com/b.srs"}]}`, "повторный tag"},
+		{"path and url", `{"rules":[{"outbound":"direct","domain":["a.ru"]}],"rule_sets":[{"tag":"ru","path":"` + setPath + `","url":"https://example.com/ru.srs"}]}`, "ровно один из path и url"},
+		{"missing path", `{"rules":[{"outbound":"direct","domain":["a.ru"]}],"rule_sets":[{"tag":"ru","path":"` + filepath.Join(dir, "missing.srs") + `"}]}`, `rule set "ru"`},
+		{"bad url", `{"rules":[{"outbound":"direct","domain":["a.ru"]}],"rule_sets":[{"tag":"ru","url":"ftp://example.com/ru.srs"}]}`, "неверный url"},
+		{"bad detour", `{"rules":[{"outbound":"direct","domain":["a.ru"]}],"rule_sets":[{"tag":"ru","url":"https://example.com/ru.srs","download_detour":"block"}]}`, "download_detour"},
+		{"bad final", `{"rules":[{"outbound":"direct","domain":["a.ru"]}],"final":"block"}`, "final должен быть"},
+		{"bad dns server", `{"dns":[{"server":"fakeip","domain":["a.ru"]}]}`, "server должен быть local или remote"},
+		{"dns no matchers", `{"dns":[{"server":"local"}]}`, "dns[0]: нет ни одного условия"},
+		{"dns undefined rule set", `{"dns":[{"server":"local","rule_set":["ru"]}]}`, "dns[0]: rule set"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "rules.json")
+			if err := os.WriteFile(path, []byte(tt.raw), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := loadRoutingRules(path)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadRoutingRulesNormalizes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	raw := `{"rules":[{"outbound":" Proxy ","ip_cidr":["10.0.0.1","2001:db8::1","192.168.0.0/16"]}],"final":"Direct","dns":[{"server":"LOCAL","domain":["corp"]}]}`
+	if err := os.WriteFile(path, []byte(raw), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := loadRoutingRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rules.Rules[0].Outbound; got != ruleOutboundProxy {
+		t.Errorf("outbound = %q, want proxy", got)
+	}
+	if got, want := rules.Rules[0].IPCIDR, []string{"10.0.0.1/32", "2001:db8::1/128", "192.168.0.0/16"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ip_cidr = %v, want %v", got, want)
+	}
+	if got := rules.final(); got != ruleOutboundDirect {
+		t.Errorf("final() = %q, want direct", got)
+	}
+	if got := rules.DNS[0].Server; got != "local" {
+		t.Errorf("dns server = %q, want local", got)
+	}
+	if got := (*routingRules)(nil).final(); got != ruleOutboundProxy {
+		t.Errorf("nil final() = %q, want proxy", got)
+	}
+}
+
+func TestRoutingRulesCompile(t *testing.T) {
+	rules := &routingRules{
+		Rules: []routingRule{
+			{Outbound: ruleOutboundDirect, DomainSuffix: []string{"ru"}, IPCIDR: []string{"10.0.0.0/8"}},
+			{Outbound: ruleOutboundBlock, DomainKeyword: []string{"ads"}},
+			{Outbound: ruleOutboundProxy, RuleSet: []string{"blocked"}, UserID: []int{1000}},
+			{Outbound: ruleOutboundDirect, ProcessName: []string{"steam"}},
+		},
+		RuleSets: []routingRuleSet{
+			{Tag: "ru", Path: "/etc/subbox/ru.srs"},
+			{Tag: "blocked", URL: "https://example.com/blocked.JSON?v=2", DownloadDetour: ruleOutboundProxy, UpdateInterval: "24h"},
+			{Tag: "ads", URL: "https://example.com/ads.srs"},
+		},
+		DNS: []routingDNSRule{
+			{Server: "remote", Domain: []string{"vpn.corp.ru"}},
+		},
+	}
+
+	t.Run("routeRules", func(t *testing.T) {
+		want := []any{
+			map[string]any{"domain_suffix": []string{"ru"}, "ip_cidr": []string{"10.0.0.0/8"}, "outbound": "direct"},
+			map[string]any{"domain_keyword": []string{"ads"}, "action": "reject"},
+			map[string]any{"rule_set": []string{"blocked"}, "user_id": []int{1000}, "outbound": "proxy"},
+			map[string]any{"process_name": []string{"steam"}, "outbound": "direct"},
+		}
+		if got := rules.routeRules(); !reflect.DeepEqual(got, want) {
+			t.Errorf("routeRules() = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("dnsRules", func(t *testing.T) {
+		tests := []struct {
+			outbound string
+			want     []any
+		}{
+			{ruleOutboundDirect, []any{map[string]any{"domain_suffix": []string{"ru"}, "server": "local"}}},
+			{ruleOutboundProxy, []any{map[string]any{"rule_set": []string{"blocked"}, "server": "local"}}},
+			{ruleOutboundBlock, []any{map[string]any{"domain_keyword": []string{"ads"}, "server": "local"}}},
+		}
+		for _, tt := range tests {
+			if got := rules.dnsRules(tt.outbound, "local"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dnsRules(%q) = %v, want %v", tt.outbound, got, tt.want)
+			}
+		}
+	})
+
+	t.Run("userDNSRules", func(t *testing.T) {
+		want := []any{map[string]any{"server": "remote", "domain": []string{"vpn.corp.ru"}}}
+		if got := rules.userDNSRules(); !reflect.DeepEqual(got, want) {
+			t.Errorf("userDNSRules() = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("ruleSets", func(t *testing.T) {
+		want := []any{
+			map[string]any{"tag": "ru", "type": "local", "path": "/etc/subbox/ru.srs", "format": "binary"},
+			map[string]any{"tag": "blocked", "type": "remote", "url": "https://example.com/blocked.JSON?v=2", "download_detour": "proxy", "update_interval": "24h", "format": "source"},
+			map[string]any{"tag": "ads", "type": "remote", "url": "https://example.com/ads.srs", "download_detour": "direct", "format": "binary"},
+		}
+		if got := rules.ruleSets(); !reflect.DeepEqual(got, want) {
+			t.Errorf("ruleSets() = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("nil", func(t *testing.T) {
+		var none *routingRules
+		if none.routeRules() != nil || none.dnsRules(ruleOutboundDirect, "local") != nil || none.userDNSRules() != nil || none.ruleSets() != nil {
+			t.Errorf("nil rules must compile to nothing")
+		}
+	})
+}
+
+func TestAppRoutingRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []string
+		want    []routingRule
+		wantErr string
+	}{
+		{
+			name:   "process names",
+			values: []string{"steam", "Telegram.exe"},
+			want:   []routingRule{{Outbound: ruleOutboundDirect, ProcessName: []string{"steam", "Telegram.exe"}}},
+		},
+		{
+			name:   "one rule per kind",
+			values: []string{"package:org.telegram.messenger", "/usr/bin/curl", "user:alice", "uid:1000", `C:\Games\game.exe`, "firefox", "package:com.whatsapp"},
+			want: []routingRule{
+				{Outbound: ruleOutboundDirect, ProcessName: []string{"firefox"}},
+				{Outbound: ruleOutboundDirect, ProcessPath: []string{"/usr/bin/curl", `C:\Games\game.exe`}},
+				{Outbound: ruleOutboundDirect, PackageName: []string{"org.telegram.messenger", "com.whatsapp"}},
+				{Outbound: ruleOutboundDirect, User: []string{"alice"}},
+				{Outbound: ruleOutboundDirect, UserID: []int{1000}},
+			},
+		},
+		{name: "bad uid", values: []string{"uid:root"}, wantErr: "неверный uid"},
+		{name: "negative uid", values: []string{"uid:-1"}, wantErr: "неверный uid"},
+		{name: "unknown prefix", values: []string{"app:steam"}, wantErr: "неизвестный тип"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := appRoutingRules(tt.values, ruleOutboundDirect)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("appRoutingRules() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package app
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// searchMatch is how one entry matched the menu search query. Entries whose
+// every term is a plain substring rank above scattered fuzzy matches.
+type searchMatch struct {
+	fuzzy     bool
+	nameMarks map[int]bool
+}
+
+func parseSearchTerms(query string) [][]rune {
+	var terms [][]rune
+	for _, field := range strings.Fields(query) {
+		terms = append(terms, []rune(strings.ToLower(field)))
+	}
+	return terms
+}
+
+// filterEntries keeps the entries matching every term, substring matches
+// first; within each group the incoming (ranked) order is preserved.
+func filterEntries(entries []proxyEntry, query string) ([]proxyEntry, map[string]searchMatch) {
+	terms := parseSearchTerms(query)
+	if len(terms) == 0 {
+		return entries, nil
+	}
+
+	matches := make(map[string]searchMatch)
+	var filtered []proxyEntry
+	for _, entry := range entries {
+		match, ok := matchEntry(entry, terms)
+		if !ok {
+			continue
+		}
+		matches[entry.raw] = match
+		filtered = append(filtered, entry)
+	}
+	sort.SliceStable(filtered, func(i, j int) bool {
+		return !matches[filtered[i].raw].fuzzy && matches[filtered[j].raw].fuzzy
+	})
+	return filtered, matches
+}
+
+// matchEntry matches every term against the name and the other fields,
+// preferring substring over fuzzy matches and the name over other fields.
+// Name positions are highlighted only for terms the name itself matched.
+func matchEntry(entry proxyEntry, terms [][]rune) (searchMatch, bool) {
+	name := []rune(entry.name)
+	fields := entrySearchFields(entry)
+	match := searchMatch{nameMarks: map[int]bool{}}
+	for _, term := range terms {
+		positions, substring, ok := fuzzyMatch(name, term)
+		if !ok || !substring {
+			fieldOK, fieldSubstring := false, false
+			for _, field := range fields {
+				if _, sub, ok := fuzzyMatch([]rune(field), term); ok {
+					fieldOK = true
+					if sub {
+						fieldSubstring = true
+						break
+					}
+				}
+			}
+			// A field substring beats a fuzzy name match.
+			if fieldOK && (!ok || fieldSubstring) {
+				positions, substring, ok = nil, fieldSubstring, true
+			}
+		}
+		if !ok {
+			return searchMatch{}, false
+		}
+		for _, pos := range positions {
+			match.nameMarks[pos] = true
+		}
+		if !substring {
+			match.fuzzy = true
+		}
+	}
+	return match, true
+}
+
+// entrySearchFields lists what the search looks at besides the name.
+func entrySearchFields(entry proxyEntry) []string {
+	fields := []string{entry.country, entry.exitCountry}
+	if entry.uri != nil {
+		transport := strings.TrimSpace(entry.uri.Query().Get("type"))
+		if transport == "" {
+			transport = "tcp"
+		}
+		fields = append(fields, entry.uri.Hostname(), transport)
+	}
+	return fields
+}
+
+// fuzzyMatch finds term in text case-insensitively: as a substring if
+// possible, otherwise as a subsequence. It returns the matched rune positions.
+func fuzzyMatch(text, term []rune) ([]int, bool, bool) {
+	if len(term) == 0 {
+		return nil, true, true
+	}
+	lower := make([]rune, len(text))
+	for i, r := range text {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	for start := 0; start+len(term) <= len(lower); start++ {
+		if string(lower[start:start+len(term)]) == string(term) {
+			positions := make([]int, len(term))
+			for i := range term {
+				positions[i] = start + i
+			}
+			return positions, true, true
+		}
+	}
+
+	positions := make([]int, 0, len(term))
+	next := 0
+	for i := 0; i < len(lower) && next < len(term); i++ {
+		if lower[i] == term[next] {
+			positions = append(positions, i)
+			next++
+		}
+	}
+	if next < len(term) {
+		return nil, false, false
+	}
+	return positions, false, true
+}
+
+// highlightRunes marks runes of line starting at offset whose position
+// relative to offset is in marks. It only toggles the foreground colour, so
+// an enclosing bold attribute stays intact.
+func highlightRunes(line string, offset int, marks map[int]bool) string {
+	if len(marks) == 0 {
+		return line
+	}
+	var b strings.Builder
+	for i, r := range []rune(line) {
+		marked := i >= offset && marks[i-offset]
+		if marked {
+			b.WriteString("\033[33m")
+		}
+		b.WriteRune(r)
+		if marked {
+			b.WriteString("\033[39m")
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,74 @@
+package app
+
+import (
+	"net/url"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestFuzzyMatch(t *testing.T) {
+	tests := []struct {
+		text, term    string
+		wantPositions []int
+		wantSubstring bool
+		wantOK        bool
+	}{
+		{"Germany", "", nil, true, true},
+		{"Germany", "germ", []int{0, 1, 2, 3}, true, true},
+		{"NL Amsterdam", "ams", []int{3, 4, 5}, true, true},
+		{"NL Amsterdam", "nlam", []int{0, 1, 3, 4}, false, true},
+		{"Österreich", "öst", []int{0, 1, 2}, true, true},
+		{"Frankfurt", "ff", []int{0, 5}, false, true},
+		{"Germany", "gx", nil, false, false},
+		{"DE", "deu", nil, false, false},
+	}
+	for _, tt := range tests {
+		positions, substring, ok := fuzzyMatch([]rune(tt.text), []rune(tt.term))
+		if !reflect.DeepEqual(positions, tt.wantPositions) || substring != tt.wantSubstring || ok != tt.wantOK {
+			t.Errorf("fuzzyMatch(%q, %q) = %v, %v, %v; want %v, %v, %v",
+				tt.text, tt.term, positions, substring, ok, tt.wantPositions, tt.wantSubstring, tt.wantOK)
+		}
+	}
+}
+
+func TestMatchEntryMarks(t *testing.T) {
+	uri, err := url.Parse("vless://id@nl.example.com:443?type=grpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := proxyEntry{name: "Netherlands Amsterdam", country: "NL", uri: uri}
+	tests := []struct {
+		query     string
+		wantMarks []int
+		wantFuzzy bool
+		wantOK    bool
+	}{
+		{"ams", []int{12, 13, 14}, false, true},
+		// The country matches as a substring; the scattered n…l in the
+		// name must not be highlighted.
+		{"nl", nil, false, true},
+		{"grpc", nil, false, true},
+		{"ntrl", []int{0, 2, 5, 6}, true, true},
+		{"ams nl", []int{12, 13, 14}, false, true},
+		{"xyz", nil, false, false},
+	}
+	for _, tt := range tests {
+		match, ok := matchEntry(entry, parseSearchTerms(tt.query))
+		if ok != tt.wantOK {
+			t.Errorf("%q: ok = %v, want %v", tt.query, ok, tt.wantOK)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		var marks []int
+		for pos := range match.nameMarks {
+			marks = append(marks, pos)
+		}
+		sort.Ints(marks)
+		if !reflect.DeepEqual(marks, tt.wantMarks) || match.fuzzy != tt.wantFuzzy {
+			t.Errorf("%q: marks %v fuzzy %v, want %v fuzzy %v", tt.query, marks, match.fuzzy, tt.wantMarks, tt.wantFuzzy)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package app
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"os"
@@ -10,48 +11,198 @@ import (
 	"strings"
 	"time"
 
-	"github.com/manifoldco/promptui"
 	"golang.org/x/term"
 )
 
-func chooseEntry(entries []proxyEntry, opts options) (proxyEntry, error) {
+const (
+	sortByHealth      = "health"
+	sortBySpeed       = "speed"
+	sortByRTT         = "rtt"
+	sortByHTTP        = "http"
+	sortByName        = "name"
+	sortByReliability = "reliability"
+)
+
+// entryColumn is one probe result column shown next to the entry name.
+type entryColumn struct {
+	title  string
+	format func(proxyEntry) string
+	width  int
+}
+
+// chooseEntries returns the node to run, or several nodes for a urltest
+// group, best first.
+func chooseEntries(ctx context.Context, entries []proxyEntry, state *userState, opts options) ([]proxyEntry, error) {
 	if opts.selectedIndex > 0 {
 		if opts.selectedIndex > len(entries) {
-			return proxyEntry{}, fmt.Errorf("индекс %d вне диапазона 1..%d", opts.selectedIndex, len(entries))
+			return nil, fmt.Errorf("индекс %d вне диапазона 1..%d", opts.selectedIndex, len(entries))
 		}
-		return entries[opts.selectedIndex-1], nil
+		return entries[opts.selectedIndex-1 : opts.selectedIndex], nil
 	}
+	if opts.selectLast {
+		if entry, ok := state.lastEntry(entries); ok {
+			return []proxyEntry{entry}, nil
+		}
+		if state.LastID == "" {
+			return nil, errors.New("последний конфиг еще не выбирался")
+		}
+		return nil, fmt.Errorf("последний конфиг %q больше не найден в подписке", state.LastName)
+	}
+	if opts.selectID != "" {
+		entry, err := findEntryByID(entries, opts.selectID)
+		if err != nil {
+			return nil, err
+		}
+		return []proxyEntry{entry}, nil
+	}
+	if opts.selectName != "" {
+		matched, err := matchEntriesByName(entries, opts.selectName)
+		if err != nil {
+			return nil, err
+		}
+		if len(matched) == 1 && !opts.autoSelect && opts.groupTop == 0 {
+			return matched, nil
+		}
+		fmt.Printf("По --select-name найдено конфигов: %d\n", len(matched))
+		entries = matched
+	}
+
+	// --select-name without --auto still picks without a prompt: the best
+	// ranked match wins regardless of thresholds.
+	unattended := opts.autoSelect || opts.groupTop > 0 || opts.selectName != ""
+	interactive := term.IsTerminal(int(os.Stdin.Fd())) && !unattended
+	board := newProbeBoard(entries, interactive)
+
+	if interactive {
+		// The menu opens right away and fills in as probes finish. Picking
+		// a node cancels whatever is still running.
+		runner := newProbeRunner(ctx, board, opts)
+		runner.probe(nil)
+		chosen, err := chooseEntryWithArrows(board, runner, state, opts)
+		done, running := runner.stop()
+		if running {
+			fmt.Println("Остановка проверок...")
+		}
+		<-done
+		return chosen, err
+	}
+
+	probeCtx, stopProbes := newProbeContext(ctx, opts.probeDeadline)
+	if unattended {
+		probeEntries(probeCtx, board, opts)
+		cancelled := errors.Is(probeCtx.Err(), context.Canceled)
+		stopProbes()
+		if cancelled {
+			return nil, errors.New("автовыбор прерван")
+		}
+		switch {
+		case opts.groupTop > 0:
+			return chooseEntriesAuto(entries, opts.groupTop, opts)
+		case opts.autoSelect:
+			return chooseEntriesAuto(entries, 1, opts)
+		}
+		return entries[:1], nil
+	}
+
+	probeEntries(probeCtx, board, opts)
+	stopProbes()
+	printSortMode(opts)
+	entry, err := chooseEntryByNumber(entries)
+	if err != nil {
+		return nil, err
+	}
+	return []proxyEntry{entry}, nil
+}
+
+// probeEntries runs every enabled probe stage and leaves entries sorted. When
+// ctx is cancelled the remaining stages are skipped and entries keep whatever
+// results were collected so far.
+func probeEntries(ctx context.Context, board *probeBoard, opts options) {
+	count := len(board.targetIndexes())
+	probeEntriesCountry(ctx, board, opts)
 
 	if !opts.skipRTT {
-		fmt.Printf("RTT тест %d конфигов...\n", len(entries))
-		probeEntriesRTT(entries, opts.probeTimeout, opts.probeWorkers)
+		board.logf("RTT тест %d конфигов...", count)
+		probeEntriesRTT(ctx, board, opts)
 	} else {
-		fmt.Println("RTT тест пропущен (--skip-rtt/--skip-tests)")
+		board.logf("RTT тест пропущен (--skip-rtt/--skip-tests)")
 	}
 
-	if opts.healthCheck && !opts.skipHTTP {
-		fmt.Printf("HTTP тест %d конфигов...\n", len(entries))
-		probeEntriesHTTP(entries, opts)
-	} else {
-		fmt.Println("HTTP тест пропущен (--skip-http/--skip-tests/--health-check=false)")
+	if opts.healthCheck && !opts.skipHTTP && ctx.Err() == nil {
+		board.logf("HTTP тест %d конфигов...", count)
+		probeEntriesHTTP(ctx, board, opts)
+	} else if !opts.healthCheck || opts.skipHTTP {
+		board.logf("HTTP тест пропущен (--skip-http/--skip-tests/--health-check=false)")
 	}
 
-	sortEntries(entries, opts.healthCheck && !opts.skipHTTP)
-	if opts.healthCheck && !opts.skipHTTP {
-		fmt.Println("Сортировка: сначала HTTP OK, затем по RTT")
+	if opts.exitIPCheck && ctx.Err() == nil {
+		board.logf("Проверка exit IP...")
+		probeEntriesExitIP(ctx, board, opts)
 	}
 
-	fd := int(os.Stdin.Fd())
-	if term.IsTerminal(fd) {
-		return chooseEntryWithArrows(entries)
+	if opts.udpCheck && ctx.Err() == nil {
+		board.logf("UDP тест через %s...", opts.udpDNS)
+		probeEntriesUDP(ctx, board, opts)
+	}
+
+	if !opts.noHistory && (!opts.skipRTT || !opts.skipHTTP) {
+		now := time.Now()
+		entries, indexes := board.stage()
+		history, err := recordProbeHistory(entries, indexes, opts.historyPath, now)
+		if err != nil {
+			board.logf("История проверок не обновлена: %v", err)
+		}
+		if history != nil {
+			board.update(func(entries []proxyEntry) {
+				scoreEntries(entries, history, now)
+			})
+		}
+	}
+
+	withHTTP := opts.healthCheck && !opts.skipHTTP
+	board.update(func(entries []proxyEntry) {
+		sortEntries(entries, sortByHealth, withHTTP)
+	})
+	if opts.speedTest && ctx.Err() == nil {
+		board.logf("Тест скорости до %d лучших конфигов...", opts.speedTop)
+		probeEntriesSpeed(ctx, board, opts)
+	}
+	board.update(func(entries []proxyEntry) {
+		sortEntries(entries, opts.sortBy, withHTTP)
+	})
+
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		board.logf("Достигнут probe-deadline, показаны уже полученные результаты")
+	case ctx.Err() != nil:
+		board.logf("Проверки прерваны, показаны уже полученные результаты")
+	case board.live:
+		board.logf("Проверки завершены")
+	}
+}
+
+func printSortMode(opts options) {
+	switch {
+	case opts.sortBy == sortBySpeed:
+		fmt.Println("Сортировка: сначала по скорости загрузки, затем по живости")
+	case opts.sortBy == sortByRTT:
+		fmt.Println("Сортировка: по RTT")
+	case opts.sortBy == sortByHTTP:
+		fmt.Println("Сортировка: по задержке HTTP")
+	case opts.sortBy == sortByName:
+		fmt.Println("Сортировка: по имени")
+	case opts.sortBy == sortByReliability:
+		fmt.Println("Сортировка: по надежности из истории")
+	case opts.healthCheck && !opts.skipHTTP:
+		fmt.Println("Сортировка: сначала HTTP OK, затем по RTT")
 	}
-	return chooseEntryByNumber(entries)
 }
 
 func chooseEntryByNumber(entries []proxyEntry) (proxyEntry, error) {
+	columns := entryColumns(entries)
 	fmt.Println("Доступные конфиги:")
 	for i, entry := range entries {
-		fmt.Printf("%2d) [RTT:%-7s HTTP:%-8s] %s\n", i+1, formatProbeStatus(entry), formatHTTPStatus(entry), entry.name)
+		fmt.Printf("%2d) [%s] %s\n", i+1, renderColumns(entry, columns, ":", " "), displayName(entry))
 	}
 
 	reader := bufio.NewReader(os.Stdin)
@@ -71,71 +222,121 @@ func chooseEntryByNumber(entries []proxyEntry) (proxyEntry, error) {
 	}
 }
 
-func chooseEntryWithArrows(entries []proxyEntry) (proxyEntry, error) {
-	type menuItem struct {
-		Index int
-		RTT   string
-		HTTP  string
-		Name  string
+func displayName(entry proxyEntry) string {
+	if entry.favorite {
+		return "★ " + entry.name
 	}
+	return entry.name
+}
 
-	termWidth := 100
-	if width, _, err := term.GetSize(int(os.Stdout.Fd())); err == nil && width > 0 {
-		termWidth = width
+func entryColumns(entries []proxyEntry) []entryColumn {
+	columns := []entryColumn{
+		{title: "ID", format: formatNodeID, width: 8},
+		{title: "RTT", format: formatProbeStatus, width: 7},
+		{title: "HTTP", format: formatHTTPStatus, width: 8},
 	}
-	maxName := termWidth - 36
-	if maxName < 16 {
-		maxName = 16
+	for _, entry := range entries {
+		if entryCountry(entry) != "" {
+			columns = append(columns, entryColumn{title: "CC", format: formatCountry, width: 2})
+			break
+		}
 	}
-
-	items := make([]menuItem, 0, len(entries))
-	for i, entry := range entries {
-		items = append(items, menuItem{
-			Index: i + 1,
-			RTT:   fmt.Sprintf("%-7s", formatProbeStatus(entry)),
-			HTTP:  fmt.Sprintf("%-8s", formatHTTPStatus(entry)),
-			Name:  clipRunes(entry.name, maxName),
-		})
+	for _, entry := range entries {
+		if entry.udpTested {
+			columns = append(columns, entryColumn{title: "UDP", format: formatUDPStatus, width: 7})
+			break
+		}
 	}
-
-	size := minInt(20, len(items))
-	if size < 5 {
-		size = len(items)
+	for _, entry := range entries {
+		if entry.speedTested {
+			columns = append(columns, entryColumn{title: "Speed", format: formatSpeedStatus, width: 9})
+			break
+		}
 	}
-
-	selector := promptui.Select{
-		Label: "Выберите конфиг (стрелки, Enter; Ctrl+C - выход)",
-		Items: items,
-		Size:  size,
-		Templates: &promptui.SelectTemplates{
-			Active:   "▸ {{ printf \"%2d\" .Index }} | RTT {{ .RTT }} | HTTP {{ .HTTP }} | {{ .Name }}",
-			Inactive: "  {{ printf \"%2d\" .Index }} | RTT {{ .RTT }} | HTTP {{ .HTTP }} | {{ .Name }}",
-			Selected: "Выбран: {{ printf \"%2d\" .Index }} | RTT {{ .RTT }} | HTTP {{ .HTTP }} | {{ .Name }}",
-			Label:    "{{ . }}",
-		},
+	for _, entry := range entries {
+		if entry.rtt6.samples > 0 {
+			columns = append(columns, entryColumn{title: "IP", format: formatFamilyStatus, width: 6})
+			break
+		}
+	}
+	for _, entry := range entries {
+		if entry.historyScored {
+			columns = append(columns, entryColumn{title: "Rel", format: formatReliability, width: 4})
+			break
+		}
+	}
+	for _, entry := range entries {
+		if entry.exitTested {
+			columns = append(columns, entryColumn{title: "Exit", format: formatExitStatus, width: 9})
+			break
+		}
 	}
+	for i := range columns {
+		columns[i].width = columnWidth(entries, columns[i].format, columns[i].width)
+	}
+	return columns
+}
 
-	index, _, err := selector.Run()
-	if err != nil {
-		return proxyEntry{}, errors.New("выбор отменен")
+func renderColumns(entry proxyEntry, columns []entryColumn, labelSep, columnSep string) string {
+	parts := make([]string, 0, len(columns))
+	for _, column := range columns {
+		parts = append(parts, fmt.Sprintf("%s%s%-*s", column.title, labelSep, column.width, column.format(entry)))
 	}
-	return entries[index], nil
+	return strings.Join(parts, columnSep)
 }
 
-func sortEntries(entries []proxyEntry, withHTTP bool) {
+func sortEntries(entries []proxyEntry, mode string, withHTTP bool) {
 	sort.SliceStable(entries, func(i, j int) bool {
 		a := entries[i]
 		b := entries[j]
 
-		if withHTTP {
+		if a.favorite != b.favorite {
+			return a.favorite
+		}
+
+		switch mode {
+		case sortBySpeed:
+			as := speedOK(a)
+			bs := speedOK(b)
+			if as != bs {
+				return as
+			}
+			if as && a.speedMbps != b.speedMbps {
+				return a.speedMbps > b.speedMbps
+			}
+		case sortByHTTP:
+			ah := a.httpTested && a.httpOK
+			bh := b.httpTested && b.httpOK
+			if ah != bh {
+				return ah
+			}
+			if ah && a.httpLatency != b.httpLatency {
+				return a.httpLatency < b.httpLatency
+			}
+		case sortByName:
+			if an, bn := strings.ToLower(a.name), strings.ToLower(b.name); an != bn {
+				return an < bn
+			}
+		case sortByReliability:
+			if a.historyScored != b.historyScored {
+				return a.historyScored
+			}
+			if a.reliability != b.reliability {
+				return a.reliability > b.reliability
+			}
+		}
+
+		if withHTTP && mode != sortByRTT {
 			ab := healthBucket(a)
 			bb := healthBucket(b)
 			if ab != bb {
 				return ab < bb
 			}
 			if ab == 0 {
-				if a.httpLatency != b.httpLatency {
-					return a.httpLatency < b.httpLatency
+				ah := a.httpStats.penalize(a.httpLatency) + reliabilityPenalty(a)
+				bh := b.httpStats.penalize(b.httpLatency) + reliabilityPenalty(b)
+				if ah != bh {
+					return ah < bh
 				}
 			}
 		}
@@ -149,7 +350,14 @@ func sortEntries(entries []proxyEntry, withHTTP bool) {
 	})
 }
 
+func speedOK(entry proxyEntry) bool {
+	return entry.speedTested && entry.speedErr == ""
+}
+
 func healthBucket(entry proxyEntry) int {
+	if entry.exitLeak {
+		return 2
+	}
 	if entry.httpTested && entry.httpOK {
 		return 0
 	}
@@ -161,11 +369,31 @@ func healthBucket(entry proxyEntry) int {
 
 func probeLatencyOrMax(entry proxyEntry) time.Duration {
 	if entry.tested && entry.probeErr == "" {
-		return entry.latency
+		return entry.rttStats.penalize(entry.latency) + reliabilityPenalty(entry)
 	}
 	return 10 * time.Second
 }
 
+// reliabilityPenalty ranks historically unstable nodes below stable ones with
+// a similar latency; nodes without enough history get a neutral score.
+func reliabilityPenalty(entry proxyEntry) time.Duration {
+	if !entry.historyScored {
+		return 0
+	}
+	return time.Duration((1 - entry.reliability) * float64(flakyPenalty))
+}
+
+func formatCountry(entry proxyEntry) string {
+	if country := entryCountry(entry); country != "" {
+		return country
+	}
+	return "--"
+}
+
+func formatNodeID(entry proxyEntry) string {
+	return entry.id
+}
+
 func formatProbeStatus(entry proxyEntry) string {
 	if !entry.tested {
 		return "--"
@@ -177,9 +405,107 @@ func formatProbeStatus(entry proxyEntry) string {
 	if ms < 1 {
 		ms = 1
 	}
+	if entry.rttStats.samples > 1 {
+		return fmt.Sprintf("%dms %s", ms, formatLoss(entry.rttStats))
+	}
 	return fmt.Sprintf("%dms", ms)
 }
 
+func formatFamilyStatus(entry proxyEntry) string {
+	if !entry.tested {
+		return "--"
+	}
+	var parts []string
+	for _, family := range []struct {
+		label string
+		stats probeStats
+	}{{"v4", entry.rtt4}, {"v6", entry.rtt6}} {
+		if family.stats.samples == 0 {
+			continue
+		}
+		if family.stats.failures == family.stats.samples {
+			parts = append(parts, family.label+" ✗")
+			continue
+		}
+		parts = append(parts, family.label+" "+formatDetailDuration(family.stats.median))
+	}
+	if len(parts) == 0 {
+		return "--"
+	}
+	return strings.Join(parts, " ")
+}
+
+func formatUDPStatus(entry proxyEntry) string {
+	if !entry.udpTested {
+		return "--"
+	}
+	if !entry.udpOK {
+		if entry.udpErr == "" {
+			return "fail"
+		}
+		return clipRunes(entry.udpErr, 7)
+	}
+	ms := entry.udpLatency.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	if entry.udpStats.samples > 1 {
+		return fmt.Sprintf("%dms %s", ms, formatLoss(entry.udpStats))
+	}
+	return fmt.Sprintf("%dms", ms)
+}
+
+func formatSpeedStatus(entry proxyEntry) string {
+	if !entry.speedTested {
+		return "--"
+	}
+	if entry.speedErr != "" {
+		return clipRunes(entry.speedErr, 9)
+	}
+	return fmt.Sprintf("%.1fMb/s", entry.speedMbps)
+}
+
+func formatExitStatus(entry proxyEntry) string {
+	if !entry.exitTested {
+		return "--"
+	}
+	if entry.exitErr != "" {
+		return clipRunes(entry.exitErr, 9)
+	}
+	status := entry.exitIP
+	if entry.exitCountry != "" {
+		status += " " + entry.exitCountry
+	}
+	if entry.exitLeak {
+		status = "LEAK " + status
+	}
+	return clipRunes(status, 28)
+}
+
+func formatReliability(entry proxyEntry) string {
+	if !entry.historyScored {
+		return "--"
+	}
+	if entry.historyRecords < historyMinRecords {
+		return "new"
+	}
+	return fmt.Sprintf("%.0f%%", entry.reliability*100)
+}
+
+func formatLoss(stats probeStats) string {
+	return fmt.Sprintf("%.0f%%", stats.lossRatio()*100)
+}
+
+func columnWidth(entries []proxyEntry, format func(proxyEntry) string, min int) int {
+	width := min
+	for _, entry := range entries {
+		if n := len([]rune(format(entry))); n > width {
+			width = n
+		}
+	}
+	return width
+}
+
 func formatHTTPStatus(entry proxyEntry) string {
 	if !entry.httpTested {
 		return "--"
@@ -0,0 +1,35 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatFamilyStatus(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry proxyEntry
+		want  string
+	}{
+		{"untested", proxyEntry{}, "--"},
+		{"both families", proxyEntry{probeResults: probeResults{
+			tested: true,
+			rtt4:   probeStats{samples: 3, median: 35 * time.Millisecond},
+			rtt6:   probeStats{samples: 3, median: 42 * time.Millisecond},
+		}}, "v4 35ms v6 42ms"},
+		{"v6 down", proxyEntry{probeResults: probeResults{
+			tested: true,
+			rtt4:   probeStats{samples: 3, failures: 1, median: 12 * time.Millisecond},
+			rtt6:   probeStats{samples: 3, failures: 3},
+		}}, "v4 12ms v6 ✗"},
+		{"v6 only", proxyEntry{probeResults: probeResults{
+			tested: true,
+			rtt6:   probeStats{samples: 1, median: 500 * time.Microsecond},
+		}}, "v6 1ms"},
+	}
+	for _, tt := range tests {
+		if got := formatFamilyStatus(tt.entry); got != tt.want {
+			t.Errorf("%s: formatFamilyStatus = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
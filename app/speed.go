@@ -0,0 +1,113 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"time"
+)
+
+func probeEntriesSpeed(ctx context.Context, board *probeBoard, opts options) {
+	entries, indexes := board.stage()
+	candidates := speedCandidates(entries, indexes, opts.speedTop)
+	if len(candidates) == 0 {
+		return
+	}
+
+	if _, err := exec.LookPath(opts.singBoxBinary); err != nil {
+		board.update(func(entries []proxyEntry) {
+			for _, idx := range candidates {
+				entries[idx].speedTested = true
+				entries[idx].speedErr = "skip"
+			}
+		})
+		return
+	}
+
+	// Nodes are measured one by one: parallel downloads would share the
+	// local link and understate every result.
+	progress := board.newProgress("Speed", len(candidates))
+	for _, idx := range candidates {
+		if ctx.Err() != nil {
+			break
+		}
+		mbps, _, err := probeEntrySpeed(ctx, entries[idx], opts)
+		if err != nil && ctx.Err() != nil {
+			break
+		}
+		board.update(func(entries []proxyEntry) {
+			entries[idx].speedTested = true
+			if err != nil {
+				entries[idx].speedErr = normalizeHTTPProbeError(err)
+				return
+			}
+			entries[idx].speedMbps = mbps
+		})
+		progress.record(err == nil, entries[idx].name, 0)
+	}
+	progress.finish()
+}
+
+// speedCandidates returns the first top alive entries among indexes, so the
+// slice is expected to be sorted by health already.
+func speedCandidates(entries []proxyEntry, indexes []int, top int) []int {
+	var candidates []int
+	for _, i := range indexes {
+		if len(candidates) >= top {
+			break
+		}
+		if healthBucket(entries[i]) < 2 {
+			candidates = append(candidates, i)
+		}
+	}
+	return candidates
+}
+
+func probeEntrySpeed(ctx context.Context, entry proxyEntry, opts options) (float64, int64, error) {
+	proxy, err := startProbeProxy(ctx, entry, opts, opts.speedTimeout+4*time.Second, probeTrafficSpeed)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer proxy.stop()
+
+	return measureDownload(ctx, newProxyHTTPClient(proxy.addr), opts.speedURL, opts.speedMaxBytes, opts.speedTimeout)
+}
+
+// measureDownload reads at most maxBytes of the response within timeout and
+// returns the transfer rate in Mbit/s. Hitting the time cap mid-download is
+// not an error: the bytes received so far are still a valid measurement.
+func measureDownload(ctx context.Context, client *http.Client, requestURL string, maxBytes int64, timeout time.Duration) (float64, int64, error) {
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("User-Agent", "subbox-speed/1.0")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return 0, 0, fmt.Errorf("speed-url вернул HTTP %d", resp.StatusCode)
+	}
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, maxBytes))
+	elapsed := time.Since(start)
+	if err != nil && (ctx.Err() == nil || parent.Err() != nil || n == 0) {
+		return 0, n, err
+	}
+	if n == 0 || elapsed <= 0 {
+		return 0, n, errors.New("speed-url вернул пустой ответ")
+	}
+	return float64(n) * 8 / elapsed.Seconds() / 1e6, n, nil
+}
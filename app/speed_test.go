@@ -0,0 +1,70 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMeasureDownload(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 1<<20)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(body)
+	}))
+	defer server.Close()
+
+	mbps, n, err := measureDownload(context.Background(), server.Client(), server.URL, 256<<10, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 256<<10 {
+		t.Errorf("read %d bytes, want the %d byte cap", n, 256<<10)
+	}
+	if mbps <= 0 {
+		t.Errorf("mbps = %v, want > 0", mbps)
+	}
+
+	if _, _, err := measureDownload(context.Background(), server.Client(), server.URL+"/missing", 1<<10, 5*time.Second); err == nil {
+		t.Error("HTTP 404 must be an error")
+	}
+}
+
+func TestSpeedCandidates(t *testing.T) {
+	entries := []proxyEntry{
+		{probeResults: probeResults{tested: true, httpTested: true, httpOK: true}},
+		{probeResults: probeResults{tested: true, probeErr: "timeout"}},
+		{probeResults: probeResults{tested: true, httpTested: true, httpOK: true}},
+		{probeResults: probeResults{tested: true, httpTested: true, httpOK: true}},
+	}
+	got := speedCandidates(entries, []int{0, 1, 2, 3}, 2)
+	if len(got) != 2 || got[0] != 0 || got[1] != 2 {
+		t.Errorf("speedCandidates = %v, want [0 2]", got)
+	}
+}
+
+func TestProbeProxyRouteLoopback(t *testing.T) {
+	tests := []struct {
+		traffic    probeTraffic
+		wantDirect bool
+	}{
+		{probeTrafficTCP, false},
+		{probeTrafficUDP, false},
+		{probeTrafficSpeed, true},
+	}
+	for _, tt := range tests {
+		route := probeProxyRoute(tt.traffic)
+		if route["final"] != "proxy" {
+			t.Errorf("traffic %d: final = %v, want proxy", tt.traffic, route["final"])
+		}
+		if _, ok := route["rules"]; ok != tt.wantDirect {
+			t.Errorf("traffic %d: loopback direct rule present = %v, want %v", tt.traffic, ok, tt.wantDirect)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const stateVersion = 1
+
+// userState is what the user chose rather than what probes measured: the
+// last launched node and the favourites. Nodes are referenced by node ID, so
+// the state survives renames and re-ordering in the subscription and never
+// holds the node credentials.
+type userState struct {
+	Version   int               `json:"version"`
+	LastID    string            `json:"last_id,omitempty"`
+	LastName  string            `json:"last_name,omitempty"`
+	Favorites map[string]string `json:"favorites,omitempty"`
+
+	// path is empty when the state must not be written, either because it
+	// is disabled or because the existing file could not be read.
+	path string
+}
+
+func defaultStatePath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil || dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, "subbox", "state.json")
+}
+
+// defaultFakeIPCachePath keeps the sing-box cache next to other subbox
+// caches rather than with the user's configuration.
+func defaultFakeIPCachePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil || dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, "subbox", "fakeip.db")
+}
+
+// loadUserState never fails the run: on a broken file it returns an empty
+// state that is not saved back, so the file is left for the user to fix.
+func loadUserState(path string) (*userState, error) {
+	state := &userState{Version: stateVersion, Favorites: map[string]string{}}
+	if path == "" {
+		return state, nil
+	}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		state.path = path
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("чтение %s: %w", path, err)
+	}
+	if err := json.Unmarshal(raw, state); err != nil {
+		state = &userState{Version: stateVersion, Favorites: map[string]string{}}
+		return state, fmt.Errorf("разбор %s: %w", path, err)
+	}
+	if state.Favorites == nil {
+		state.Favorites = map[string]string{}
+	}
+	state.path = path
+	return state, nil
+}
+
+func (s *userState) save() error {
+	if s.path == "" {
+		return nil
+	}
+	s.Version = stateVersion
+	raw, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal state: %w", err)
+	}
+	return writeFileAtomic(s.path, raw)
+}
+
+func (s *userState) markFavorites(entries []proxyEntry) {
+	for i := range entries {
+		_, entries[i].favorite = s.Favorites[entries[i].id]
+	}
+}
+
+// toggleFavorite flips the favourite flag of entry and reports the new value.
+func (s *userState) toggleFavorite(entry proxyEntry) bool {
+	if _, ok := s.Favorites[entry.id]; ok {
+		delete(s.Favorites, entry.id)
+		return false
+	}
+	s.Favorites[entry.id] = entry.name
+	return true
+}
+
+func (s *userState) rememberLast(entry proxyEntry) {
+	s.LastID = entry.id
+	s.LastName = entry.name
+}
+
+func (s *userState) lastEntry(entries []proxyEntry) (proxyEntry, bool) {
+	if s.LastID == "" {
+		return proxyEntry{}, false
+	}
+	for _, entry := range entries {
+		if entry.id == s.LastID {
+			return entry, true
+		}
+	}
+	return proxyEntry{}, false
+}
@@ -0,0 +1,61 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUserStateSavesNoCredential(t *testing.T) {
+	key := "vless://11111111-1111-1111-1111-111111111111@example.com:443?security=tls"
+	entry := proxyEntry{key: key, id: nodeID(key), name: "NL"}
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	state, err := loadUserState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.toggleFavorite(entry)
+	state.rememberLast(entry)
+	if err := state.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(saved), "11111111-1111") {
+		t.Errorf("saved state contains the node UUID: %s", saved)
+	}
+	loaded, err := loadUserState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := loaded.lastEntry([]proxyEntry{entry}); !ok || got.id != entry.id {
+		t.Errorf("lastEntry after reload = %+v, %v", got, ok)
+	}
+	if _, ok := loaded.Favorites[entry.id]; !ok {
+		t.Errorf("favourite lost on reload: %v", loaded.Favorites)
+	}
+}
+
+func TestUserStateFavoritesByID(t *testing.T) {
+	state := &userState{Favorites: map[string]string{}}
+	entry := proxyEntry{key: "vless://secret@host:443?", id: "abcd1234", name: "NL"}
+
+	if !state.toggleFavorite(entry) {
+		t.Fatal("first toggle must add the favourite")
+	}
+	if _, ok := state.Favorites[entry.id]; !ok {
+		t.Errorf("favourite not stored by ID: %v", state.Favorites)
+	}
+	state.rememberLast(entry)
+	if got, ok := state.lastEntry([]proxyEntry{entry}); !ok || got.id != entry.id {
+		t.Errorf("lastEntry = %+v, %v", got, ok)
+	}
+	if state.toggleFavorite(entry) {
+		t.Error("second toggle must remove the favourite")
+	}
+}
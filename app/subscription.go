@@ -2,11 +2,14 @@ package app
 
 import (
 	"bufio"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"regexp"
@@ -20,17 +23,64 @@ var schemePattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*://`)
 type proxyEntry struct {
 	raw  string
 	name string
+	key  string
+	id   string
 	uri  *url.URL
 
+	favorite bool
+	country  string
+
+	historyScored  bool
+	historyRecords int
+	reliability    float64
+
+	probeResults
+}
+
+// probeResults is everything the probe stages measure for a node; a re-test
+// resets it as a whole and keeps the rest of the entry.
+type probeResults struct {
 	tested   bool
 	latency  time.Duration
 	probeErr string
+	// probeErrDetail and httpErrDetail keep the full error text for the
+	// details pane; probeErr and httpErr are short codes for the columns.
+	probeErrDetail string
+	rttStats       probeStats
+	rtt4           probeStats
+	rtt6           probeStats
 
 	httpTested  bool
 	httpOK      bool
 	httpStatus  int
 	httpLatency time.Duration
 	httpErr     string
+	httpStats   probeStats
+
+	httpErrDetail string
+
+	speedTested bool
+	speedMbps   float64
+	speedErr    string
+
+	exitTested  bool
+	exitIP      string
+	exitCountry string
+	exitLeak    bool
+	exitErr     string
+
+	udpTested  bool
+	udpOK      bool
+	udpLatency time.Duration
+	udpStats   probeStats
+	udpErr     string
+}
+
+// withoutProbeResults drops everything measured by the probes; the identity
+// of the node, its favourite flag and its history score are kept.
+func (e proxyEntry) withoutProbeResults() proxyEntry {
+	e.probeResults = probeResults{}
+	return e
 }
 
 func fetchSubscription(rawURL string) ([]proxyEntry, error) {
@@ -74,9 +124,12 @@ func fetchSubscription(rawURL string) ([]proxyEntry, error) {
 		if _, err := buildVLESSOutbound(uri); err != nil {
 			continue
 		}
+		key := canonicalNodeKey(uri)
 		entries = append(entries, proxyEntry{
 			raw:  raw,
 			name: buildDisplayName(uri),
+			key:  key,
+			id:   nodeID(key),
 			uri:  uri,
 		})
 	}
@@ -210,6 +263,39 @@ func buildDisplayName(uri *url.URL) string {
 	return fmt.Sprintf("%s:%s", host, port)
 }
 
+// canonicalNodeKey identifies a node independently of its display name and of
+// parameter order in the link, so results survive subscription re-ordering
+// and renames.
+func canonicalNodeKey(uri *url.URL) string {
+	if uri == nil {
+		return ""
+	}
+	port := uri.Port()
+	if port == "" {
+		port = "443"
+	}
+	query := uri.Query()
+	for key, values := range query {
+		for i := range values {
+			values[i] = strings.TrimSpace(values[i])
+		}
+		query[key] = values
+	}
+	return fmt.Sprintf("%s://%s@%s?%s",
+		strings.ToLower(uri.Scheme),
+		strings.TrimSpace(uri.User.Username()),
+		net.JoinHostPort(strings.ToLower(uri.Hostname()), port),
+		query.Encode(),
+	)
+}
+
+// nodeID is a short stable handle for a node, derived from its canonical key
+// so it survives renames and re-ordering in the subscription.
+func nodeID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:4])
+}
+
 func buildVLESSOutbound(uri *url.URL) (map[string]any, error) {
 	if uri == nil {
 		return nil, errors.New("пустой URL")
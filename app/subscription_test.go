@@ -0,0 +1,25 @@
+package app
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestWithoutProbeResults(t *testing.T) {
+	uri, _ := url.Parse("vless://id@example.com:443#NL")
+	entry := proxyEntry{
+		raw: "vless://id@example.com:443#NL", name: "NL", key: "key", id: "abcd1234", uri: uri,
+		favorite: true, country: "NL",
+		historyScored: true, historyRecords: 4, reliability: 0.9,
+		probeResults: probeResults{tested: true, probeErr: "timeout", httpTested: true, exitCountry: "DE", udpOK: true},
+	}
+
+	got := entry.withoutProbeResults()
+	if got.probeResults != (probeResults{}) {
+		t.Errorf("probe results kept: %+v", got.probeResults)
+	}
+	got.probeResults = entry.probeResults
+	if got != entry {
+		t.Errorf("identity changed:\n got %+v\nwant %+v", got, entry)
+	}
+}
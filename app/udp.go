@@ -0,0 +1,318 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// udpProbeDomain is the name looked up through each node. Any resolvable
+// name works; only the fact that an answer came back over UDP matters.
+const udpProbeDomain = "www.google.com"
+
+func probeEntriesUDP(ctx context.Context, board *probeBoard, opts options) {
+	entries, indexes := board.stage()
+	var candidates []int
+	for _, i := range indexes {
+		if healthBucket(entries[i]) < 2 {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		return
+	}
+
+	if _, err := exec.LookPath(opts.singBoxBinary); err != nil {
+		board.update(func(entries []proxyEntry) {
+			for _, idx := range candidates {
+				entries[idx].udpTested = true
+				entries[idx].udpErr = "skip"
+			}
+		})
+		return
+	}
+
+	progress := board.newProgress("UDP", len(candidates))
+	runProbePool(ctx, candidates, opts.healthWorkers,
+		func(idx int) probeOutcome {
+			stats, err := probeEntryUDP(ctx, entries[idx], opts)
+			return probeOutcome{stats: stats, err: err}
+		},
+		func(idx int, res probeOutcome) {
+			if res.err != nil && ctx.Err() != nil {
+				return
+			}
+			board.update(func(entries []proxyEntry) {
+				entries[idx].udpTested = true
+				entries[idx].udpStats = res.stats
+				entries[idx].udpLatency = res.stats.median
+				if res.err != nil {
+					entries[idx].udpErr = normalizeHTTPProbeError(res.err)
+					return
+				}
+				entries[idx].udpOK = true
+			})
+			progress.record(res.err == nil, entries[idx].name, res.stats.median)
+		},
+	)
+	progress.finish()
+}
+
+func probeEntryUDP(ctx context.Context, entry proxyEntry, opts options) (probeStats, error) {
+	samples := opts.healthSamples
+	if samples < 1 {
+		samples = 1
+	}
+	proxy, err := startProbeProxy(ctx, entry, opts, time.Duration(samples)*opts.healthTimeout+4*time.Second, probeTrafficUDP)
+	if err != nil {
+		return probeStats{}, err
+	}
+	defer proxy.stop()
+
+	latencies := make([]time.Duration, 0, samples)
+	failures := 0
+	var lastErr error
+	for sample := 0; sample < samples; sample++ {
+		latency, err := querySOCKS5UDP(ctx, proxy.addr, opts.udpDNS, opts.healthTimeout)
+		if err != nil && samples == 1 && sleepContext(ctx, 200*time.Millisecond) == nil {
+			// UDP is lossy by design, so a single sample gets one retry.
+			latency, err = querySOCKS5UDP(ctx, proxy.addr, opts.udpDNS, opts.healthTimeout)
+		}
+		if ctx.Err() != nil {
+			return newProbeStats(latencies, failures), ctx.Err()
+		}
+		if err != nil {
+			failures++
+			lastErr = err
+			continue
+		}
+		latencies = append(latencies, latency)
+	}
+
+	stats := newProbeStats(latencies, failures)
+	if len(latencies) == 0 {
+		return stats, lastErr
+	}
+	return stats, nil
+}
+
+// querySOCKS5UDP sends one DNS query to resolver through the UDP ASSOCIATE
+// relay of the mixed inbound at proxyAddr and returns the round-trip time.
+func querySOCKS5UDP(ctx context.Context, proxyAddr, resolver string, timeout time.Duration) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	var dialer net.Dialer
+	control, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return 0, err
+	}
+	defer control.Close()
+	_ = control.SetDeadline(deadline)
+	// The relay lives as long as the control connection; closing it on
+	// cancellation also unblocks the reads below.
+	stop := context.AfterFunc(ctx, func() { _ = control.Close() })
+	defer stop()
+
+	relayAddr, err := socks5UDPAssociate(control)
+	if err != nil {
+		return 0, err
+	}
+	if relayAddr.IP.IsUnspecified() {
+		host, _, _ := net.SplitHostPort(proxyAddr)
+		relayAddr.IP = net.ParseIP(host)
+	}
+
+	conn, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(deadline)
+	stopUDP := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stopUDP()
+
+	header, err := socks5UDPHeader(resolver)
+	if err != nil {
+		return 0, err
+	}
+	query, id, err := buildDNSQuery(udpProbeDomain)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	if _, err := conn.Write(append(header, query...)); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			return 0, err
+		}
+		payload, err := stripSOCKS5UDPHeader(buf[:n])
+		if err != nil {
+			return 0, err
+		}
+		if err := checkDNSResponse(payload, id); err != nil {
+			if errors.Is(err, errDNSForeignReply) {
+				continue
+			}
+			return 0, err
+		}
+		return time.Since(start), nil
+	}
+}
+
+// socks5UDPAssociate performs the no-auth greeting and UDP ASSOCIATE on the
+// control connection and returns the relay address announced by the server.
+func socks5UDPAssociate(conn net.Conn) (*net.UDPAddr, error) {
+	if _, err := conn.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	if reply[0] != 0x05 || reply[1] != 0x00 {
+		return nil, errors.New("socks5: прокси требует аутентификацию")
+	}
+
+	if _, err := conn.Write([]byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0}); err != nil {
+		return nil, err
+	}
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return nil, err
+	}
+	if head[1] != 0x00 {
+		return nil, fmt.Errorf("socks5: UDP ASSOCIATE отклонен (код %d)", head[1])
+	}
+
+	var ip net.IP
+	switch head[3] {
+	case 0x01:
+		ip = make(net.IP, net.IPv4len)
+	case 0x04:
+		ip = make(net.IP, net.IPv6len)
+	default:
+		return nil, fmt.Errorf("socks5: неожиданный тип адреса %d", head[3])
+	}
+	if _, err := io.ReadFull(conn, ip); err != nil {
+		return nil, err
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(port))}, nil
+}
+
+func socks5UDPHeader(target string) ([]byte, error) {
+	host, portRaw, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portRaw)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("неверный порт: %q", portRaw)
+	}
+
+	header := []byte{0x00, 0x00, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			header = append(header, 0x01)
+			header = append(header, ip4...)
+		} else {
+			header = append(header, 0x04)
+			header = append(header, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("слишком длинное имя: %q", host)
+		}
+		header = append(header, 0x03, byte(len(host)))
+		header = append(header, host...)
+	}
+	return binary.BigEndian.AppendUint16(header, uint16(port)), nil
+}
+
+func stripSOCKS5UDPHeader(packet []byte) ([]byte, error) {
+	if len(packet) < 4 || packet[2] != 0x00 {
+		return nil, errors.New("socks5: неверный UDP пакет")
+	}
+	offset := 4
+	switch packet[3] {
+	case 0x01:
+		offset += net.IPv4len
+	case 0x04:
+		offset += net.IPv6len
+	case 0x03:
+		if len(packet) < 5 {
+			return nil, errors.New("socks5: неверный UDP пакет")
+		}
+		offset += 1 + int(packet[4])
+	default:
+		return nil, errors.New("socks5: неверный UDP пакет")
+	}
+	offset += 2
+	if len(packet) < offset {
+		return nil, errors.New("socks5: неверный UDP пакет")
+	}
+	return packet[offset:], nil
+}
+
+var errDNSForeignReply = errors.New("dns: ответ на другой запрос")
+
+// buildDNSQuery encodes a recursive A query for name with a random ID.
+func buildDNSQuery(name string) ([]byte, uint16, error) {
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = append(msg, 0x01, 0x00) // RD
+	msg = append(msg, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return nil, 0, fmt.Errorf("неверное имя: %q", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0x00, 0x00, 0x01, 0x00, 0x01) // root, A, IN
+	return msg, id, nil
+}
+
+// checkDNSResponse accepts any well-formed answer to the query, including
+// NXDOMAIN: the resolver replied, so UDP works through the node.
+func checkDNSResponse(msg []byte, id uint16) error {
+	if len(msg) < 12 {
+		return errors.New("dns: короткий ответ")
+	}
+	if binary.BigEndian.Uint16(msg[:2]) != id {
+		return errDNSForeignReply
+	}
+	if msg[2]&0x80 == 0 {
+		return errors.New("dns: получен запрос вместо ответа")
+	}
+	if rcode := msg[3] & 0x0f; rcode != 0 && rcode != 3 {
+		return fmt.Errorf("dns: rcode %d", rcode)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestSOCKS5UDPHeader(t *testing.T) {
+	tests := []struct {
+		target  string
+		want    []byte
+		wantErr bool
+	}{
+		{"1.1.1.1:53", []byte{0, 0, 0, 0x01, 1, 1, 1, 1, 0, 53}, false},
+		{"[2001:db8::1]:443", append(append([]byte{0, 0, 0, 0x04}, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1), 0x01, 0xbb), false},
+		{"dns.google:53", append(append([]byte{0, 0, 0, 0x03, 10}, "dns.google"...), 0, 53), false},
+		{"1.1.1.1", nil, true},
+		{"1.1.1.1:0", nil, true},
+		{"1.1.1.1:65536", nil, true},
+		{string(bytes.Repeat([]byte("a"), 256)) + ":53", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := socks5UDPHeader(tt.target)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("socks5UDPHeader(%q) error = %v, wantErr %v", tt.target, err, tt.wantErr)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("socks5UDPHeader(%q) = %v, want %v", tt.target, got, tt.want)
+		}
+		if err == nil {
+			payload, err := stripSOCKS5UDPHeader(append(got, 0xaa))
+			if err != nil || !bytes.Equal(payload, []byte{0xaa}) {
+				t.Errorf("stripSOCKS5UDPHeader(header of %q) = %v, %v", tt.target, payload, err)
+			}
+		}
+	}
+}
+
+func TestCheckDNSResponse(t *testing.T) {
+	reply := func(id uint16, flags1, flags2 byte) []byte {
+		return []byte{byte(id >> 8), byte(id), flags1, flags2, 0, 1, 0, 1, 0, 0, 0, 0}
+	}
+	tests := []struct {
+		name    string
+		msg     []byte
+		wantErr bool
+		foreign bool
+	}{
+		{"answer", reply(0x1234, 0x81, 0x80), false, false},
+		{"nxdomain", reply(0x1234, 0x81, 0x83), false, false},
+		{"servfail", reply(0x1234, 0x81, 0x82), true, false},
+		{"refused", reply(0x1234, 0x81, 0x85), true, false},
+		{"query echoed", reply(0x1234, 0x01, 0x00), true, false},
+		{"other id", reply(0x4321, 0x81, 0x80), true, true},
+		{"short", reply(0x1234, 0x81, 0x80)[:11], true, false},
+	}
+	for _, tt := range tests {
+		err := checkDNSResponse(tt.msg, 0x1234)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if errors.Is(err, errDNSForeignReply) != tt.foreign {
+			t.Errorf("%s: error = %v, foreign reply %v", tt.name, err, tt.foreign)
+		}
+	}
+
+	query, id, err := buildDNSQuery("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkDNSResponse(query, id); err == nil {
+		t.Errorf("checkDNSResponse accepted the query itself")
+	}
+}
@@ -3,11 +3,6 @@ module subbox
 go 1.24.0
 
 require (
-	github.com/manifoldco/promptui v0.9.0
+	golang.org/x/sys v0.41.0
 	golang.org/x/term v0.40.0
 )
-
-require (
-	github.com/chzyer/readline v0.0.0-20180603132655-2972be24d48e // indirect
-	golang.org/x/sys v0.41.0 // indirect
-)